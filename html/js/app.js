@@ -21,6 +21,20 @@
 (function() {
   var app = angular.module('webtox', ['fullscreen', 'mozWebApp', 'notifications', 'websocket']);
 
+  // redirect to the login page if the session has expired
+  app.config(['$httpProvider', function($httpProvider) {
+    $httpProvider.interceptors.push(['$q', '$window', function($q, $window) {
+      return {
+        'responseError': function(response) {
+          if (response.status === 401) {
+            $window.location.href = 'login';
+          }
+          return $q.reject(response);
+        }
+      };
+    }]);
+  }]);
+
   app.controller('webtoxCtrl', ['$scope', '$http', 'Fullscreen', 'MozWebApp', 'Notifications', 'WS', function($scope, $http, FullscreenService, WebApp, Notifications, WS) {
     'use strict';
 
@@ -46,6 +60,12 @@
       message: '',
     };
     $scope.settings = {};
+    $scope.network = {};
+    $scope.transfers = [];
+    $scope.newAutoAcceptRule = {
+      publicKey: '',
+      max_size_mib: 10
+    };
     $scope.curDate = Date.now(); // current unix timestap used to work around caching
 
     var getContactIndexByNum = function(num) {
@@ -108,6 +128,7 @@
     // == Settings ==
     $scope.showSettings = function() {
       $scope.active_mainview = 'settings';
+      fetchStorage();
     };
 
     // == Messages ==
@@ -251,6 +272,246 @@
       });
     });
 
+    $scope.totp = {};
+
+    $scope.enrollTOTP = function() {
+      $http.post('api/post/totp_enroll', {}).success(function(data) {
+        $scope.totp = {enrollment: data};
+      });
+    };
+
+    $scope.confirmTOTP = function() {
+      $http.post('api/post/totp_confirm', {
+        code: $scope.totp.code
+      }).success(function(data) {
+        $scope.totp = {recoveryCodes: data.recovery_codes};
+      }).error(function(data) {
+        $scope.totp.error = data.message;
+      });
+    };
+
+    $scope.newRecoveryCodes = function() {
+      $http.post('api/post/totp_recovery_codes', {
+        code: $scope.totp.code
+      }).success(function(data) {
+        $scope.totp = {recoveryCodes: data.recovery_codes};
+      }).error(function(data) {
+        $scope.totp.error = data.message;
+      });
+    };
+
+    $scope.disableTOTP = function() {
+      $http.post('api/post/totp_disable', {
+        code: $scope.totp.code
+      }).success(function() {
+        $scope.totp = {};
+      }).error(function(data) {
+        $scope.totp.error = data.message;
+      });
+    };
+
+    $scope.newAPIToken = {scopes: {}, friends: {}};
+
+    $scope.createAPIToken = function() {
+      var scopes = [], friends = [];
+      angular.forEach($scope.newAPIToken.scopes, function(enabled, scope) {
+        if (enabled) scopes.push(scope);
+      });
+      angular.forEach($scope.newAPIToken.friends, function(enabled, publicKey) {
+        if (enabled) friends.push(publicKey);
+      });
+
+      $http.post('api/post/api_token_create', {
+        name: $scope.newAPIToken.name,
+        scopes: scopes,
+        friends: friends
+      }).success(function(data) {
+        $scope.newAPIToken = {scopes: {}, friends: {}, created: data.token};
+        fetchAPITokens();
+      }).error(function(data) {
+        $scope.newAPIToken.error = data.message;
+      });
+    };
+
+    $scope.revokeAPIToken = function(token) {
+      $http.post('api/post/api_token_revoke', {
+        id: token.id
+      }).success(fetchAPITokens);
+    };
+
+    $scope.clearLoginBlock = function(block) {
+      $http.post('api/post/login_blocks_clear', {
+        type: block ? block.type : '',
+        key: block ? block.key : ''
+      }).success(fetchLoginBlocks);
+    };
+
+    $scope.chooseAvatar = function() {
+      $('#profile-card-picture-file').click();
+    };
+
+    $('#profile-card-picture-file').change(function() {
+      var input = this;
+      if (input.files.length === 0)
+        return;
+
+      var form = new FormData();
+      form.append('file', input.files[0]);
+      input.value = '';
+
+      $scope.$apply(function() {
+        $http.post('api/avatar', form, {
+          transformRequest: angular.identity,
+          headers: {'Content-Type': undefined}
+        }).error(function(data) {
+          alert(data.message);
+        });
+      });
+    });
+
+    $scope.removeAvatar = function() {
+      $http.delete('api/avatar').error(function(data) {
+        alert(data.message);
+      });
+    };
+
+    $scope.chooseFile = function() {
+      $('#mainview-chat-footer-file').click();
+    };
+
+    $('#mainview-chat-footer-file').change(function() {
+      var input = this;
+      if (input.files.length === 0)
+        return;
+
+      var contact = $scope.contacts[$scope.activecontactindex];
+      if (!contact.online) {
+        alert("User is offline. :(");
+        input.value = '';
+        return;
+      }
+
+      var form = new FormData();
+      form.append('file', input.files[0]);
+      input.value = '';
+
+      $scope.$apply(function() {
+        $http.post('api/files?friend=' + contact.number, form, {
+          transformRequest: angular.identity,
+          headers: {'Content-Type': undefined}
+        }).error(function(data) {
+          alert(data.message);
+        });
+      });
+    });
+
+    $scope.getTransfer = function(id) {
+      for (var i in $scope.transfers)
+        if ($scope.transfers[i].id === id) return $scope.transfers[i];
+      return null;
+    };
+
+    $scope.getContactName = function(publicKey) {
+      for (var i in $scope.contacts)
+        if ($scope.contacts[i].publicKey.toUpperCase() === publicKey.toUpperCase()) return $scope.contacts[i].name;
+      return publicKey;
+    };
+
+    $scope.acceptTransfer = function(transfer, saveAs) {
+      var name = '';
+      if (saveAs) {
+        name = prompt("Save as", transfer.name);
+        if (name === null)
+          return;
+      }
+
+      $http.post('api/post/file_accept', {
+        friend: transfer.friend,
+        file: transfer.file,
+        name: name
+      }).success(fetchTransfers).error(function(data) {
+        alert(data.message);
+        fetchTransfers();
+      });
+    };
+
+    $scope.rejectTransfer = function(transfer) {
+      $http.post('api/post/file_reject', {
+        friend: transfer.friend,
+        file: transfer.file
+      }).success(fetchTransfers).error(fetchTransfers);
+    };
+
+    var controlTransfer = function(action, transfer) {
+      $http.post('api/post/transfer_' + action, {
+        friend: transfer.friend,
+        file: transfer.file
+      }).error(function(data) {
+        alert(data.message);
+        fetchTransfers();
+      });
+    };
+
+    $scope.pauseTransfer = function(transfer) {
+      controlTransfer('pause', transfer);
+    };
+
+    $scope.resumeTransfer = function(transfer) {
+      controlTransfer('resume', transfer);
+    };
+
+    $scope.cancelTransfer = function(transfer) {
+      controlTransfer('cancel', transfer);
+    };
+
+    $scope.deleteFile = function(file) {
+      if (!confirm("Delete " + file.name + " from the server?"))
+        return;
+
+      $http.post('api/post/delete_file', {
+        id: file.id
+      }).success(function() {
+        fetchContactlist();
+        fetchStorage();
+      }).error(function(data) {
+        alert(data.message);
+      });
+    };
+
+    var saveAutoAcceptRules = function(rules) {
+      $http.post('api/post/auto_accept', {
+        rules: rules
+      }).success(fetchSettings).error(function(data) {
+        alert(data.message);
+        fetchSettings();
+      });
+    };
+
+    $scope.addAutoAcceptRule = function() {
+      var maxSize = parseFloat($scope.newAutoAcceptRule.max_size_mib);
+      if (!(maxSize > 0))
+        return;
+
+      var rules = ($scope.settings.auto_accept || []).slice();
+      rules.push({
+        publicKey: $scope.newAutoAcceptRule.publicKey || '',
+        max_size: Math.round(maxSize * 1048576)
+      });
+      saveAutoAcceptRules(rules);
+    };
+
+    $scope.removeAutoAcceptRule = function(index) {
+      var rules = $scope.settings.auto_accept.slice();
+      rules.splice(index, 1);
+      saveAutoAcceptRules(rules);
+    };
+
+    $scope.logout = function() {
+      $http.post('api/post/logout', {}).then(function() {
+        location.href = 'login';
+      });
+    };
+
     $('#checkbox-notifications').change(function() {
       $http.post('api/post/keyValue', {
         key: 'settings_notifications_enabled',
@@ -269,6 +530,24 @@
       });
     });
 
+    $scope.saveNetworkSettings = function() {
+      var tox = $scope.settings.tox;
+      $http.post('api/post/settings_network', {
+        ipv6_enabled: tox.ipv6_enabled,
+        udp_enabled: tox.udp_enabled,
+        proxy_type: tox.proxy_type,
+        proxy_host: tox.proxy_host,
+        proxy_port: parseInt(tox.proxy_port, 10),
+        start_port: parseInt(tox.start_port, 10),
+        end_port: parseInt(tox.end_port, 10)
+      }).success(function() {
+        fetchNetwork();
+      }).error(function(data) {
+        alert(data.message);
+        fetchSettings();
+      });
+    };
+
     // == WebApp Installation ==
     $scope.appInstallationStatus = 'unknown';
 
@@ -295,12 +574,42 @@
       });
     };
 
+    var fetchNetwork = function() {
+      $http.get('api/get/network').success(function(data) {
+        $scope.network = data;
+      });
+    };
+
+    var fetchLoginBlocks = function() {
+      $http.get('api/get/login_blocks').success(function(data) {
+        $scope.loginBlocks = data;
+      });
+    };
+
+    var fetchAPITokens = function() {
+      $http.get('api/get/api_tokens').success(function(data) {
+        $scope.apiTokens = data;
+      });
+    };
+
+    var fetchStorage = function() {
+      $http.get('api/get/storage').success(function(data) {
+        $scope.storage = data;
+      });
+    };
+
     var fetchContactlist = function() {
       $http.get('api/get/contactlist').success(function(data) {
         $scope.contacts = data;
       });
     };
 
+    var fetchTransfers = function() {
+      $http.get('api/get/transfers').success(function(data) {
+        $scope.transfers = data;
+      });
+    };
+
     var fetchFriendRequests = function() {
       $http.get('api/get/friend_requests').success(function(data) {
         $scope.friendRequests = data;
@@ -329,6 +638,69 @@
       }
     });
 
+    WS.registerHandler('file_request', function(data) {
+      fetchTransfers();
+      var i = getContactIndexByNum(data.friend);
+      if (i >= 0 && i < $scope.contacts.length && $scope.settings.notifications_enabled) {
+        Notifications.show($scope.contacts[i].name, "wants to send you a file: " + data.name, "file_request"+$scope.contacts[i].number, function() {
+          $scope.showChat(data.friend);
+        });
+      }
+    });
+
+    WS.registerHandler('transfers_update', fetchTransfers);
+
+    WS.registerHandler('transfer_progress', function(data) {
+      var transfer = $scope.getTransfer(data.id);
+      if (!transfer || data.state === 'done' || data.state === 'failed' || data.state === 'interrupted') {
+        fetchTransfers();
+        return;
+      }
+      delete data.type;
+      angular.extend(transfer, data);
+    });
+
+    WS.registerHandler('file_rejected', function(data) {
+      var i = getContactIndexByNum(data.friend);
+      if (i >= 0 && i < $scope.contacts.length && $scope.settings.notifications_enabled) {
+        Notifications.show($scope.contacts[i].name, "File " + data.name + " rejected: " + data.reason, "file_rejected"+$scope.contacts[i].number);
+      }
+    });
+
+    WS.registerHandler('file_sent', function(data) {
+      fetchTransfers();
+      fetchContactlist();
+    });
+
+    WS.registerHandler('file_received', function(data) {
+      fetchTransfers();
+      var i = getContactIndexByNum(data.friend);
+      if (i >= 0 && i < $scope.contacts.length) {
+        var file = {"id": data.id, "name": data.name, "size": data.size, "complete": true};
+        var known = false;
+        angular.forEach($scope.contacts[i].chat, function(chat) {
+          if (chat.file && chat.file.id == data.id) {
+            chat.file = file;
+            known = true;
+          }
+        });
+        if (!known) {
+          $scope.contacts[i].chat.unshift({
+            "message": data.name,
+            "isIncoming": true,
+            "isAction": false,
+            "time": data.time,
+            "file": file
+          });
+        }
+        if ($scope.settings.notifications_enabled) {
+          Notifications.show($scope.contacts[i].name, "sent you a file: " + data.name, "file_received"+$scope.contacts[i].number, function() {
+            $scope.showChat(data.friend);
+          });
+        }
+      }
+    });
+
     WS.registerHandler('name_changed', function(data) {
       var i = getContactIndexByNum(data.friend);
       if (i >= 0 && i < $scope.contacts.length)
@@ -355,7 +727,17 @@
       }
     });
 
-    WS.registerHandler('profile_update', fetchProfile);
+    WS.registerHandler('self_connection_status', fetchNetwork);
+    WS.registerHandler('login_lockout', function(data) {
+      Notifications.show("WebTox", "Too many failed logins, " + data.kind + " " + data.key + " has been locked out", "login_lockout");
+      fetchLoginBlocks();
+    });
+
+    WS.registerHandler('settings_update', fetchSettings);
+    WS.registerHandler('profile_update', function() {
+      $scope.curDate = Date.now(); // reload our avatar
+      fetchProfile();
+    });
     WS.registerHandler('friendlist_update', fetchContactlist);
     WS.registerHandler('friend_requests_update', fetchFriendRequests);
 
@@ -370,6 +752,10 @@
       fetchContactlist();
       fetchFriendRequests();
       fetchSettings();
+      fetchNetwork();
+      fetchLoginBlocks();
+      fetchAPITokens();
+      fetchTransfers();
       $scope.$apply();
     };
 
@@ -12,7 +12,9 @@
       }
 
       console.log("Trying to connect to WebSocket server...");
-      var ws = new WebSocket("wss://" + location.host + "/events");
+      // the handshake has to present the CSRF token of the session
+      var csrf = document.cookie.replace(/(?:(?:^|.*;\s*)XSRF-TOKEN\s*=\s*([^;]*).*$)|^.*$/, "$1");
+      var ws = new WebSocket("wss://" + location.host + "/events?csrf=" + encodeURIComponent(csrf));
 
       ws.onopen = function() {
         if (typeof onopen === "function")
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// addressFilter decides which clients may use the HTTPS server based on their
+// IP address. Connections over Unix sockets are always allowed, access to
+// them is controlled by the file permissions.
+type addressFilter struct {
+	sync.Mutex
+	localhostOnly bool
+	allow         []*net.IPNet
+	deny          []*net.IPNet
+}
+
+var clientFilter = &addressFilter{}
+
+// parseNetworks parses a list of networks in CIDR notation. Single IP
+// addresses are accepted as well.
+// list  the networks
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// set applies the filter settings of a configuration
+// c  the configuration
+func (f *addressFilter) set(c *Config) error {
+	allow, err := parseNetworks(c.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := parseNetworks(c.Deny)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.localhostOnly = c.LocalhostOnly
+	f.allow = allow
+	f.deny = deny
+	return nil
+}
+
+// isLocalhostOnly returns true if only clients from localhost are allowed
+func (f *addressFilter) isLocalhostOnly() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.localhostOnly
+}
+
+// allowed returns true if a client may use the server
+// remoteAddr  the address of the client (as in http.Request)
+func (f *addressFilter) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Unix socket
+		return true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.localhostOnly && !ip.IsLoopback() {
+		return false
+	}
+
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictAddresses wraps h so that it is only served to allowed clients.
+// Connections are already filtered when they are accepted, but keep-alive
+// connections may outlive a change of the filter settings.
+// h  the handler to protect
+func restrictAddresses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientFilter.allowed(r.RemoteAddr) {
+			log.Println("[addressFilter] Denied request from", r.RemoteAddr, "to", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loopbackAddress rewrites a listen address without a host or with an
+// unspecified host (e.g. ":8080" or "0.0.0.0:8080") to the loopback address.
+// Other addresses are returned unchanged.
+// address  "host:port" or "unix:<path>"
+func loopbackAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || strings.HasPrefix(address, "unix:") {
+		return address
+	}
+
+	if len(host) == 0 {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ip.To4() != nil {
+			return net.JoinHostPort("127.0.0.1", port)
+		}
+		return net.JoinHostPort("::1", port)
+	}
+	return address
+}
+
+// isLoopbackAddress returns true if a listen address only accepts connections
+// from localhost
+// address  "host:port" or "unix:<path>"
+func isLoopbackAddress(address string) bool {
+	if strings.HasPrefix(address, "unix:") {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"./persistence"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API tokens let scripts and bots use the API and the WebSocket without a
+// login session. They are sent in the "Authorization: Bearer <token>" header
+// and are not subject to CSRF checks. Only the SHA-256 hash of a token is
+// stored.
+const (
+	SCOPE_READ    string = "read"    // read the friend list, chat history, files and events
+	SCOPE_SEND    string = "send"    // send messages and files (to all friends or the given ones)
+	SCOPE_FRIENDS string = "friends" // add, accept and delete friends
+	SCOPE_ADMIN   string = "admin"   // everything, including settings
+)
+
+var apiTokenScopes = map[string]bool{SCOPE_READ: true, SCOPE_SEND: true, SCOPE_FRIENDS: true, SCOPE_ADMIN: true}
+
+var (
+	ErrInvalidAPIToken   = errors.New("Invalid API token")
+	ErrInsufficientScope = errors.New("The API token does not grant the required scope")
+)
+
+// apiToken is an API token with its scopes and friends parsed
+type apiToken struct {
+	persistence.APIToken
+	scopes  map[string]bool
+	friends map[string]bool
+}
+
+// apiTokenContextKey is the key of the API token in the request context
+type apiTokenContextKey struct{}
+
+// newAPIToken parses the scopes and friends of a stored token
+func newAPIToken(t persistence.APIToken) *apiToken {
+	token := &apiToken{APIToken: t, scopes: make(map[string]bool), friends: make(map[string]bool)}
+	for _, scope := range splitList(t.Scopes) {
+		token.scopes[scope] = true
+	}
+	for _, publicKey := range splitList(t.Friends) {
+		token.friends[strings.ToUpper(publicKey)] = true
+	}
+	return token
+}
+
+// hasScope returns true if the token grants the given scope
+// scope  the scope
+func (t *apiToken) hasScope(scope string) bool {
+	return t.scopes[SCOPE_ADMIN] || t.scopes[scope]
+}
+
+// canMessage returns true if the token may send messages to a friend
+// publicKey  the public key of the friend
+func (t *apiToken) canMessage(publicKey string) bool {
+	if t.scopes[SCOPE_ADMIN] {
+		return true
+	}
+	if !t.scopes[SCOPE_SEND] {
+		return false
+	}
+	return len(t.friends) == 0 || t.friends[strings.ToUpper(publicKey)]
+}
+
+// createAPIToken creates a new API token and returns it. The token cannot be
+// retrieved later.
+// name     a name describing the token
+// scopes   the scopes granted to the token
+// friends  the public keys of the friends the token may message (or empty)
+func createAPIToken(name string, scopes []string, friends []string) (string, int64, error) {
+	if len(name) == 0 {
+		return "", -1, errors.New("The name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return "", -1, errors.New("At least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !apiTokenScopes[scope] {
+			return "", -1, errors.New("Unknown scope: " + scope)
+		}
+	}
+	for i := range friends {
+		friends[i] = strings.ToUpper(friends[i])
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", -1, err
+	}
+	token := "wt_" + secret
+
+	id, err := storage.StoreAPIToken(persistence.APIToken{
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		Friends:   strings.Join(friends, ","),
+		Created:   time.Now().Unix() * 1000,
+	})
+	return token, id, err
+}
+
+// authenticateAPIToken returns the API token of a request. The time and the
+// address the token was used from are recorded.
+// r  the request
+func authenticateAPIToken(r *http.Request) (*apiToken, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, ErrInvalidAPIToken
+	}
+
+	t, err := storage.GetAPIToken(hashToken(strings.TrimSpace(auth[len("Bearer "):])))
+	if err == persistence.APITokenNotFound {
+		return nil, ErrInvalidAPIToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	// avoid writing to the database on every request
+	now := time.Now().Unix() * 1000
+	address := remoteIP(r)
+	if now-t.LastUsed > 60*1000 || address != t.LastAddress {
+		t.LastUsed = now
+		t.LastAddress = address
+		storage.TouchAPIToken(t.ID, now, address)
+	}
+
+	return newAPIToken(t), nil
+}
+
+// requestAPIToken returns the API token a request was authenticated with or
+// nil if it was authenticated with a session
+// r  the request
+func requestAPIToken(r *http.Request) *apiToken {
+	token, _ := r.Context().Value(apiTokenContextKey{}).(*apiToken)
+	return token
+}
+
+// requiredScope returns the scope an API token needs for a path
+// path  the path of the request
+func requiredScope(path string) string {
+	switch path {
+	case "/events", "/api/post/message_read_receipt":
+		return SCOPE_READ
+	case "/api/get/settings", "/api/get/login_blocks", "/api/get/api_tokens", "/api/get/storage":
+		return SCOPE_ADMIN
+	case "/api/post/message", "/api/files":
+		return SCOPE_SEND
+	case "/api/post/friend_request", "/api/post/friend_request_is_ignored", "/api/post/friend_request_accept", "/api/post/delete_friend":
+		return SCOPE_FRIENDS
+	}
+
+	if strings.HasPrefix(path, "/api/get/") || strings.HasPrefix(path, "/api/files/") || strings.HasPrefix(path, "/api/avatar/") {
+		return SCOPE_READ
+	}
+	return SCOPE_ADMIN
+}
+
+// serveWithAPIToken serves a request authenticated with an API token if the
+// token grants the required scope
+// h  the handler
+func serveWithAPIToken(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	token, err := authenticateAPIToken(r)
+	if err != nil {
+		rejectWithStatusJSON(w, http.StatusUnauthorized, "invalid_token", "The API token is not valid.")
+		return
+	}
+
+	if !token.hasScope(requiredScope(r.URL.Path)) {
+		rejectWithStatusJSON(w, http.StatusForbidden, "insufficient_scope", "The API token does not grant access to "+r.URL.Path+".")
+		return
+	}
+
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, token)))
+}
+
+// splitList splits a comma separated list, ignoring empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); len(e) != 0 {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/codedust/go-tox"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Our own avatar is stored as PNG file in the data directory. It is offered
+// to every friend when they come online and whenever it changes, with the
+// SHA-256 hash of the image as file ID so friends can cancel transfers of
+// avatars they already have. Removing the avatar is announced with an empty
+// avatar transfer (see github.com/Tox/Tox-STS/blob/master/STS.md#avatars).
+//
+// The avatars of friends are stored in the avatars directory in the data
+// directory and served via /api/avatar/{publicKey}. Offered avatars are only
+// downloaded if their hash differs from the stored one. They are written to a
+// temporary file that replaces the stored avatar when the transfer is
+// complete.
+
+var ErrInvalidAvatar = errors.New("The avatar is not a PNG, JPEG or GIF image")
+
+// the public keys of the friends our current avatar has been offered to
+// (only accessed from the main loop)
+var avatarSent = make(map[string]bool)
+
+// selfAvatarPath returns the path to our avatar
+func selfAvatarPath() string {
+	return filepath.Join(cfg.DataDir, "avatar.png")
+}
+
+// friendAvatarDir returns the directory the avatars of friends are stored in
+func friendAvatarDir() string {
+	return filepath.Join(cfg.DataDir, "avatars")
+}
+
+// friendAvatarPath returns the path to the avatar of a friend
+// publicKey  the public key of the friend (hex encoded)
+func friendAvatarPath(publicKey string) string {
+	return filepath.Join(friendAvatarDir(), strings.ToLower(publicKey)+".png")
+}
+
+// receiveAvatar handles an avatar offered by a friend. Must only be called
+// from the main loop.
+// t             the Tox instance
+// key           the key of the transfer
+// friendnumber  the friend
+// size          the size of the avatar (0 if the friend removed the avatar)
+func receiveAvatar(t *gotox.Tox, key transferKey, friendnumber uint32, size uint64) {
+	path := friendAvatarPath(key.publicKey)
+
+	if size == 0 {
+		t.FileControl(friendnumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		if err := os.Remove(path); err == nil {
+			broadcastToClients(createSimpleJSONEvent("avatar_update"))
+		}
+		return
+	}
+
+	// only accept avatars with a file size <= CFG_MAX_AVATAR_SIZE
+	if size > CFG_MAX_AVATAR_SIZE {
+		t.FileControl(friendnumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		return
+	}
+
+	// the file ID of an avatar is its hash
+	fileID, err := t.FileGetFileId(friendnumber, key.fileNumber)
+	if data, readErr := ioutil.ReadFile(path); err == nil && readErr == nil {
+		if hash := sha256.Sum256(data); bytes.Equal(fileID, hash[:]) {
+			t.FileControl(friendnumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+			return
+		}
+	}
+
+	file, err := ioutil.TempFile(friendAvatarDir(), strings.ToLower(key.publicKey)+".png.tmp")
+	if err != nil {
+		log.Println("[receiveAvatar] Creating file failed:", err)
+		t.FileControl(friendnumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		return
+	}
+
+	transfers.set(key, FileTransfer{friendNumber: friendnumber, fileHandle: file, fileSize: size, fileKind: gotox.TOX_FILE_KIND_AVATAR, state: TRANSFER_RUNNING})
+	t.FileControl(friendnumber, key.fileNumber, gotox.TOX_FILE_CONTROL_RESUME)
+}
+
+// storeFriendAvatar replaces the avatar of a friend with a completely received
+// one. The transfer has to be finished (see finishTransfer) before.
+// key       the key of the transfer
+// transfer  the avatar transfer
+func storeFriendAvatar(key transferKey, transfer FileTransfer) {
+	if err := os.Rename(transfer.fileHandle.Name(), friendAvatarPath(key.publicKey)); err != nil {
+		log.Println("[storeFriendAvatar] Storing the avatar failed:", err)
+		os.Remove(transfer.fileHandle.Name())
+		return
+	}
+	broadcastToClients(createSimpleJSONEvent("avatar_update"))
+}
+
+// handleFriendAvatar serves the avatar of a friend or an identicon if the
+// friend has no avatar
+// w          the response
+// r          the request
+// publicKey  the public key of the friend (as in /api/avatar/{publicKey})
+func handleFriendAvatar(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rejectWithStatusJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "Avatars can only be downloaded with GET.")
+		return
+	}
+
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != gotox.TOX_PUBLIC_KEY_SIZE {
+		rejectWithStatusJSON(w, http.StatusNotFound, "avatar_not_found", "The public key is invalid.")
+		return
+	}
+
+	data, err := ioutil.ReadFile(friendAvatarPath(publicKey))
+	if err != nil {
+		data = identicon(key)
+	}
+
+	// the browser revalidates the avatar and only downloads it if it changed
+	hash := sha256.Sum256(data)
+	w.Header().Set("ETag", "\""+hex.EncodeToString(hash[:])+"\"")
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// encodeAvatar decodes an image and encodes it as PNG that is not larger than
+// CFG_MAX_AVATAR_SIZE bytes, downscaling it if needed. The dimensions are
+// checked before the image is decoded.
+// r  the image (limited to CFG_AVATAR_MAX_UPLOAD_SIZE by the caller)
+func encodeAvatar(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > CFG_AVATAR_MAX_PIXELS {
+		return nil, ErrInvalidAvatar
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidAvatar
+	}
+
+	for size := CFG_AVATAR_SIZE; size >= 16; size = size * 3 / 4 {
+		var buf bytes.Buffer
+		if err = png.Encode(&buf, scaleImage(img, size)); err != nil {
+			return nil, err
+		}
+		if uint64(buf.Len()) <= CFG_MAX_AVATAR_SIZE {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, ErrInvalidAvatar
+}
+
+// storeAvatar replaces our avatar. The new file is renamed over the old one,
+// so transfers of the old avatar can still read it.
+// data  the PNG image
+func storeAvatar(data []byte) error {
+	tmp, err := ioutil.TempFile(cfg.DataDir, "avatar.png.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), selfAvatarPath())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// sendAvatar offers our avatar to a friend or tells the friend that we do not
+// have an avatar. A running transfer of the previous avatar is cancelled.
+// Must only be called from the main loop.
+// t             the Tox instance
+// friendnumber  the friend
+func sendAvatar(t *gotox.Tox, friendnumber uint32) error {
+	key, err := friendTransferKey(t, friendnumber, 0)
+	if err != nil {
+		return err
+	}
+
+	for oldKey, transfer := range transfers.snapshot() {
+		if oldKey.publicKey == key.publicKey && transfer.outgoing && transfer.fileKind == gotox.TOX_FILE_KIND_AVATAR {
+			t.FileControl(friendnumber, oldKey.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+			finishTransfer(oldKey, transfer, TRANSFER_FAILED)
+		}
+	}
+
+	transfer := FileTransfer{friendNumber: friendnumber, fileKind: gotox.TOX_FILE_KIND_AVATAR, outgoing: true, state: TRANSFER_PENDING}
+
+	data, err := ioutil.ReadFile(selfAvatarPath())
+	if os.IsNotExist(err) {
+		// an empty avatar transfer removes our avatar
+		key.fileNumber, err = t.FileSend(friendnumber, gotox.TOX_FILE_KIND_AVATAR, 0, nil, "")
+	} else if err == nil {
+		if transfer.fileHandle, err = os.Open(selfAvatarPath()); err != nil {
+			return err
+		}
+		transfer.fileSize = uint64(len(data))
+
+		hash := sha256.Sum256(data)
+		key.fileNumber, err = t.FileSend(friendnumber, gotox.TOX_FILE_KIND_AVATAR, transfer.fileSize, hash[:], "avatar.png")
+	}
+	if err != nil {
+		if transfer.fileHandle != nil {
+			transfer.fileHandle.Close()
+		}
+		return err
+	}
+
+	transfers.set(key, transfer)
+	avatarSent[key.publicKey] = true
+	return nil
+}
+
+// broadcastAvatar offers our (changed) avatar to all friends that are online.
+// The others get it when they come online. Must only be called from the main
+// loop.
+// t  the Tox instance
+func broadcastAvatar(t *gotox.Tox) {
+	avatarSent = make(map[string]bool)
+
+	friends, _ := t.SelfGetFriendlist()
+	for _, friendnumber := range friends {
+		if status, err := t.FriendGetConnectionStatus(friendnumber); err != nil || status == gotox.TOX_CONNECTION_NONE {
+			continue
+		}
+		if err := sendAvatar(t, friendnumber); err != nil {
+			log.Println("[broadcastAvatar] Sending the avatar to friend", friendnumber, "failed:", err)
+		}
+	}
+}
+
+// handleAvatar serves (GET), replaces (POST) or removes (DELETE) our avatar
+// w  the response
+// r  the request
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		file, err := os.Open(selfAvatarPath())
+		if err != nil {
+			rejectWithStatusJSON(w, http.StatusNotFound, "avatar_not_found", "No avatar has been set.")
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			rejectWithDefaultErrorJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		http.ServeContent(w, r, "", info.ModTime(), file)
+		return
+
+	case "POST":
+		r.Body = http.MaxBytesReader(w, r.Body, CFG_AVATAR_MAX_UPLOAD_SIZE)
+		body, _, err := uploadedFile(r)
+		if err != nil {
+			rejectWithErrorJSON(w, "invalid_upload", "The request does not contain a file.")
+			return
+		}
+
+		data, err := encodeAvatar(body)
+		if err == ErrInvalidAvatar {
+			rejectWithErrorJSON(w, "invalid_avatar", err.Error()+".")
+			return
+		} else if err != nil {
+			rejectWithErrorJSON(w, "upload_failed", "The upload failed or the image is too large.")
+			return
+		}
+
+		if err = storeAvatar(data); err != nil {
+			log.Println("[handleAvatar] Storing the avatar failed:", err)
+			rejectWithDefaultErrorJSON(w)
+			return
+		}
+		log.Println("[handleAvatar] Avatar changed")
+
+	case "DELETE":
+		if err := os.Remove(selfAvatarPath()); err != nil && !os.IsNotExist(err) {
+			log.Println("[handleAvatar] Removing the avatar failed:", err)
+			rejectWithDefaultErrorJSON(w)
+			return
+		}
+		log.Println("[handleAvatar] Avatar removed")
+
+	default:
+		rejectWithStatusJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "The avatar can only be changed with POST or removed with DELETE.")
+		return
+	}
+
+	toxDo(func(t *gotox.Tox) error {
+		broadcastAvatar(t)
+		return nil
+	})
+
+	// broadcast status to all connected clients
+	broadcastToClients(createSimpleJSONEvent("profile_update"))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/codedust/go-tox"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// BootstrapNode describes a DHT node in the format used by nodes.tox.chat
+type BootstrapNode struct {
+	IPv4       string `json:"ipv4"`
+	IPv6       string `json:"ipv6"`
+	Port       int    `json:"port"`
+	TCPPorts   []int  `json:"tcp_ports"`
+	PublicKey  string `json:"public_key"`
+	Maintainer string `json:"maintainer,omitempty"`
+	Location   string `json:"location,omitempty"`
+	StatusUDP  *bool  `json:"status_udp,omitempty"`
+	StatusTCP  *bool  `json:"status_tcp,omitempty"`
+}
+
+// nodesList is the format of https://nodes.tox.chat/json
+type nodesList struct {
+	Nodes []BootstrapNode `json:"nodes"`
+}
+
+// the node used if no other nodes are known
+var fallbackNodes = []BootstrapNode{
+	{IPv4: "144.76.60.215", IPv6: "-", Port: 33445, PublicKey: "04119E835DF3E78BACF0F84235B300546AF8B936F035185E2A8E9E0A67C8924F"},
+}
+
+// bootstrapper connects the Tox instance to the DHT. It bootstraps against a
+// random subset of the known nodes, preferring nodes that worked before, and
+// bootstraps again against other nodes if the connection stays offline.
+type bootstrapper struct {
+	nodes     []BootstrapNode
+	userNodes []BootstrapNode
+	count     int
+	ipv6      bool
+
+	// the nodes used in the last bootstrap round and those of them that
+	// could be added to toxcore
+	lastRound    []BootstrapNode
+	succeeded    []BootstrapNode
+	lastAttempt  time.Time
+	recorded     bool
+	offlineSince time.Time
+}
+
+// newBootstrapper creates a bootstrapper using the nodes from a nodes list
+// file (in the nodes.tox.chat format) and the nodes from the configuration
+// nodesFile  the path to the nodes list (a missing file is not an error)
+// c          the Tox network configuration
+func newBootstrapper(nodesFile string, c *ToxConfig) *bootstrapper {
+	b := &bootstrapper{
+		userNodes: c.BootstrapNodes,
+		count:     c.BootstrapCount,
+		ipv6:      c.IPv6Enabled,
+	}
+
+	nodes, err := readNodesFile(nodesFile)
+	if err != nil {
+		log.Println("[bootstrap] Could not read nodes list", nodesFile+":", err)
+	}
+
+	for _, node := range nodes {
+		if node.isUsable() {
+			b.nodes = append(b.nodes, node)
+		}
+	}
+
+	if len(b.nodes) == 0 && len(b.userNodes) == 0 {
+		log.Println("[bootstrap] No nodes known, using the fallback node")
+		b.nodes = fallbackNodes
+	}
+
+	return b
+}
+
+// readNodesFile reads a nodes list in the nodes.tox.chat format
+// path  the path to the nodes list
+func readNodesFile(path string) ([]BootstrapNode, error) {
+	if exists, _ := fileExists(path); !exists {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list nodesList
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Nodes, nil
+}
+
+// isUsable returns false if the node has an invalid key or is known to be down
+func (n *BootstrapNode) isUsable() bool {
+	if key, err := hex.DecodeString(n.PublicKey); err != nil || len(key) != gotox.TOX_PUBLIC_KEY_SIZE {
+		return false
+	}
+
+	if n.StatusUDP != nil && n.StatusTCP != nil && !*n.StatusUDP && !*n.StatusTCP {
+		return false
+	}
+
+	return true
+}
+
+// addresses returns the addresses of the node that can be used
+// ipv6  true if IPv6 addresses should be included
+func (n *BootstrapNode) addresses(ipv6 bool) []string {
+	var addresses []string
+	if len(n.IPv4) != 0 && n.IPv4 != "-" {
+		addresses = append(addresses, n.IPv4)
+	}
+	if ipv6 && len(n.IPv6) != 0 && n.IPv6 != "-" {
+		addresses = append(addresses, n.IPv6)
+	}
+	return addresses
+}
+
+// bootstrap bootstraps the Tox instance against the selected nodes over UDP
+// and adds their TCP relays
+// t  the Tox instance
+func (b *bootstrapper) bootstrap(t *gotox.Tox) error {
+	selected := b.selectNodes()
+	b.lastRound = selected
+	b.lastAttempt = time.Now()
+	b.succeeded = nil
+	b.recorded = false
+
+	for _, node := range selected {
+		publicKey, _ := hex.DecodeString(node.PublicKey)
+		ok := false
+
+		for _, address := range node.addresses(b.ipv6) {
+			if node.StatusUDP == nil || *node.StatusUDP {
+				if err := t.Bootstrap(address, uint16(node.Port), publicKey); err == nil {
+					ok = true
+				}
+			}
+
+			if node.StatusTCP == nil || *node.StatusTCP {
+				for _, port := range node.TCPPorts {
+					if err := t.AddTcpRelay(address, uint16(port), publicKey); err == nil {
+						ok = true
+					}
+				}
+			}
+		}
+
+		if ok {
+			b.succeeded = append(b.succeeded, node)
+		} else {
+			log.Println("[bootstrap] Bootstrapping failed:", node.IPv4, node.Port)
+		}
+	}
+
+	log.Printf("[bootstrap] Bootstrapped against %d of %d nodes\n", len(b.succeeded), len(selected))
+	if len(b.succeeded) == 0 {
+		return errors.New("Bootstrapping failed")
+	}
+	return nil
+}
+
+// selectNodes returns the user nodes plus a random subset of the known nodes.
+// Up to half of the subset is taken from the nodes that worked before. Nodes
+// used in the previous round are skipped if enough other nodes are known.
+func (b *bootstrapper) selectNodes() []BootstrapNode {
+	previous := make(map[string]bool)
+	for _, node := range b.lastRound {
+		previous[strings.ToUpper(node.PublicKey)] = true
+	}
+
+	candidates := make([]BootstrapNode, 0, len(b.nodes))
+	for _, node := range b.nodes {
+		if !previous[strings.ToUpper(node.PublicKey)] {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) < b.count {
+		candidates = b.nodes
+	}
+
+	selected := append([]BootstrapNode{}, b.userNodes...)
+	chosen := make(map[string]bool)
+
+	// prefer nodes that worked before
+	for _, publicKey := range storage.GetWorkingBootstrapNodes(b.count / 2) {
+		for _, node := range candidates {
+			if strings.ToUpper(node.PublicKey) == publicKey && !chosen[publicKey] {
+				selected = append(selected, node)
+				chosen[publicKey] = true
+			}
+		}
+	}
+
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(chosen) >= b.count {
+			break
+		}
+
+		publicKey := strings.ToUpper(candidates[i].PublicKey)
+		if !chosen[publicKey] {
+			selected = append(selected, candidates[i])
+			chosen[publicKey] = true
+		}
+	}
+
+	return selected
+}
+
+// check is called regularly with the current self connection status. It
+// records the nodes of the last round that could be added to toxcore once we
+// are online and bootstraps again if we stay offline for longer than
+// CFG_BOOTSTRAP_TIMEOUT.
+// t       the Tox instance
+// status  the current self connection status
+func (b *bootstrapper) check(t *gotox.Tox, status gotox.ToxConnection) {
+	if status != gotox.TOX_CONNECTION_NONE {
+		if !b.recorded {
+			for _, node := range b.succeeded {
+				storage.StoreWorkingBootstrapNode(strings.ToUpper(node.PublicKey))
+			}
+			b.recorded = true
+		}
+		b.offlineSince = time.Time{}
+		return
+	}
+
+	if b.offlineSince.IsZero() {
+		b.offlineSince = time.Now()
+	}
+
+	if time.Since(b.offlineSince) >= CFG_BOOTSTRAP_TIMEOUT && time.Since(b.lastAttempt) >= CFG_BOOTSTRAP_TIMEOUT {
+		log.Println("[bootstrap] Still offline, bootstrapping again")
+		if err := b.bootstrap(t); err != nil {
+			log.Println("[bootstrap]", err)
+		}
+	}
+}
@@ -1,11 +1,657 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
 const (
-	CFG_DATA_DIR          string = "../data/"
-	CFG_HTML_DIR          string = "../html/"
-	CFG_IMG_DIR           string = "../html/img/"
 	CFG_CERT_PREFIX       string = "https."
 	CFG_DEFAULT_AUTH_USER string = "user"
-	CFG_TCP_PROXY_PORT    uint16 = 0
 	CFG_MAX_AVATAR_SIZE   uint64 = 65536 // see github.com/Tox/Tox-STS/blob/master/STS.md#avatars
+	CFG_AVATAR_SIZE       int    = 256   // the maximum width and height of our avatar
+	CFG_ENV_PREFIX        string = "WEBTOX_"
+
+	// thumbnails fit into a CFG_THUMBNAIL_SIZE square, larger images than
+	// CFG_THUMBNAIL_MAX_PIXELS are not decoded
+	CFG_THUMBNAIL_SIZE       int = 256
+	CFG_THUMBNAIL_MAX_PIXELS int = 40 * 1000 * 1000
+
+	// uploaded avatars may be CFG_AVATAR_MAX_UPLOAD_SIZE bytes large, larger
+	// images than CFG_AVATAR_MAX_PIXELS are not decoded
+	CFG_AVATAR_MAX_UPLOAD_SIZE int64 = 4 << 20
+	CFG_AVATAR_MAX_PIXELS      int   = 4096 * 4096
+
+	CFG_BOOTSTRAP_TIMEOUT        time.Duration = 30 * time.Second
+	CFG_BOOTSTRAP_CHECK_INTERVAL time.Duration = 5 * time.Second
+
+	CFG_DEFAULT_ITERATION_INTERVAL time.Duration = 50 * time.Millisecond
+	CFG_SHUTDOWN_TIMEOUT           time.Duration = 10 * time.Second
+	CFG_PROGRESS_INTERVAL          time.Duration = 500 * time.Millisecond
+	CFG_TRANSFER_SAVE_INTERVAL     time.Duration = 5 * time.Second
+	CFG_DOWNLOAD_CLEANUP_INTERVAL  time.Duration = time.Hour
+	CFG_SESSION_COOKIE             string        = "webtox_session"
+	CFG_CSRF_COOKIE                string        = "XSRF-TOKEN"
+	CFG_CSRF_HEADER                string        = "X-XSRF-TOKEN"
+
+	CFG_LOGIN_FREE_ATTEMPTS    int           = 3
+	CFG_LOGIN_MAX_ATTEMPTS     int           = 10
+	CFG_LOGIN_LOCKOUT_DURATION time.Duration = 15 * time.Minute
+	CFG_LOGIN_FAILURE_WINDOW   time.Duration = time.Hour
+
+	CFG_TOTP_ISSUER            string        = "WebTox"
+	CFG_TOTP_DIGITS            int           = 6
+	CFG_TOTP_PERIOD            time.Duration = 30 * time.Second
+	CFG_TOTP_RECOVERY_CODES    int           = 10
+	CFG_PENDING_LOGIN_COOKIE   string        = "webtox_login_pending"
+	CFG_PENDING_LOGIN_TIMEOUT  time.Duration = 5 * time.Minute
+	CFG_PENDING_LOGIN_ATTEMPTS int           = 5
 )
+
+// the global configuration
+var cfg = defaultConfig()
+
+// the configuration the command-line flags are bound to
+var flagCfg = defaultConfig()
+
+// the path to the config file and the flags given on the command line
+var configFile string
+var cmdlineFlags = make(map[string]string)
+
+// toxConfigMtx protects cfg.Tox, which can be changed at runtime
+var toxConfigMtx sync.Mutex
+
+// currentToxConfig returns a copy of the current Tox network configuration
+func currentToxConfig() ToxConfig {
+	toxConfigMtx.Lock()
+	defer toxConfigMtx.Unlock()
+	return cfg.Tox
+}
+
+// setToxConfig replaces the current Tox network configuration
+// c  the new Tox network configuration
+func setToxConfig(c ToxConfig) {
+	toxConfigMtx.Lock()
+	defer toxConfigMtx.Unlock()
+	cfg.Tox = c
+}
+
+// Config holds the server configuration. It is assembled from (in ascending
+// order of precedence) the defaults, the JSON config file, WEBTOX_*
+// environment variables and command-line flags.
+type Config struct {
+	ListenAddress  string   `json:"listen_address,omitempty"`
+	DataDir        string   `json:"data_dir"`
+	HTMLDir        string   `json:"html_dir"`
+	CertFile       string   `json:"cert_file"`
+	KeyFile        string   `json:"key_file"`
+	SaveFile       string   `json:"save_file"`
+	NodesFile      string   `json:"nodes_file"`
+	DownloadDir    string   `json:"download_dir"`
+	SaveInterval   Duration `json:"save_interval"`
+	SaveBackups    int      `json:"save_backups"`
+	MaxRequestSize int64    `json:"max_request_size"`
+	MaxUploadSize  int64    `json:"max_upload_size"`
+
+	// the files in DownloadDir may take up DownloadQuota bytes and a received
+	// file at most MaxFileSize bytes (0 for no limit). Files older than
+	// DownloadMaxAge are removed (0 to keep them).
+	DownloadQuota  int64    `json:"download_quota"`
+	MaxFileSize    int64    `json:"max_file_size"`
+	DownloadMaxAge Duration `json:"download_max_age"`
+
+	// lengthen the iteration interval if no web client is connected
+	LowPower         bool     `json:"low_power"`
+	LowPowerInterval Duration `json:"low_power_interval"`
+
+	// sessions expire after being unused for SessionIdleTimeout and at the
+	// latest SessionMaxAge after the login
+	SessionIdleTimeout Duration `json:"session_idle_timeout"`
+	SessionMaxAge      Duration `json:"session_max_age"`
+
+	PasswordHash PasswordHashConfig `json:"password_hash"`
+
+	// the addresses the HTTPS server listens on ("host:port" or "unix:<path>").
+	// ListenAddress is the single address used by older config files.
+	ListenAddresses []string `json:"listen_addresses"`
+
+	// only serve clients from the loopback interface (and Unix sockets)
+	LocalhostOnly bool `json:"localhost_only"`
+
+	// networks (CIDR or single IP addresses) clients may connect from. Deny
+	// takes precedence over Allow, an empty Allow list allows all clients.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	Tox ToxConfig `json:"tox"`
+
+	// the passphrase is never written to or read from the config file, but
+	// it may be read from PassphraseFile
+	Passphrase     string `json:"-"`
+	PassphraseFile string `json:"passphrase_file"`
+
+	// disable two-factor authentication on startup (if locked out)
+	DisableTOTP bool `json:"-"`
+}
+
+// ToxConfig holds the network options used to create the Tox instance
+type ToxConfig struct {
+	IPv6Enabled bool   `json:"ipv6_enabled"`
+	UDPEnabled  bool   `json:"udp_enabled"`
+	ProxyType   string `json:"proxy_type"`
+	ProxyHost   string `json:"proxy_host"`
+	ProxyPort   int    `json:"proxy_port"`
+	StartPort   int    `json:"start_port"`
+	EndPort     int    `json:"end_port"`
+	TCPPort     int    `json:"tcp_port"`
+
+	// the number of nodes to bootstrap against (in addition to BootstrapNodes)
+	BootstrapCount int             `json:"bootstrap_count"`
+	BootstrapNodes []BootstrapNode `json:"bootstrap_nodes"`
+}
+
+// Duration is a time.Duration that is encoded as a string (e.g. "5m") in JSON
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+// listValue implements flag.Value for comma separated lists
+type listValue struct{ p *[]string }
+
+func (v listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v listValue) Set(s string) error {
+	*v.p = splitList(s)
+	return nil
+}
+
+// uint32Value and uint8Value implement flag.Value for the argon2 parameters
+type uint32Value struct{ p *uint32 }
+type uint8Value struct{ p *uint8 }
+
+func (v uint32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = uint32(n)
+	return nil
+}
+
+func (v uint8Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v uint8Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return err
+	}
+	*v.p = uint8(n)
+	return nil
+}
+
+// defaultConfig returns the default configuration. Paths are relative to the
+// working directory.
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:    ":8080",
+		DataDir:          "../data/",
+		HTMLDir:          "../html/",
+		SaveInterval:     Duration{5 * time.Minute},
+		SaveBackups:      3,
+		MaxRequestSize:   1 << 20,
+		MaxUploadSize:    1 << 30,
+		LowPower:         false,
+		LowPowerInterval: Duration{250 * time.Millisecond},
+
+		SessionIdleTimeout: Duration{2 * time.Hour},
+		SessionMaxAge:      Duration{7 * 24 * time.Hour},
+
+		PasswordHash: PasswordHashConfig{
+			Algorithm:     PASSWORD_ARGON2ID,
+			Argon2Time:    1,
+			Argon2Memory:  64 * 1024,
+			Argon2Threads: 4,
+			BcryptCost:    12,
+		},
+
+		Tox: ToxConfig{
+			IPv6Enabled: true,
+			UDPEnabled:  true,
+			ProxyType:   "NONE",
+			ProxyHost:   "127.0.0.1",
+			ProxyPort:   5555,
+			StartPort:   0,
+			EndPort:     0,
+			TCPPort:     0,
+
+			BootstrapCount: 4,
+		},
+	}
+}
+
+// parseConfig parses the command-line arguments, the config file and the
+// environment into cfg. If -print-config is given, the effective
+// configuration is printed and the program exits.
+// args  the command-line arguments without the program name
+func parseConfig(args []string) error {
+	fs := flag.CommandLine
+
+	var printConfig bool
+	fs.StringVar(&configFile, "config", "", "path to the JSON config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+
+	fs.Var(listValue{&flagCfg.ListenAddresses}, "listen", "comma separated addresses the HTTPS server listens on (host:port or unix:<path>, default :8080)")
+	fs.BoolVar(&flagCfg.LocalhostOnly, "localhost-only", flagCfg.LocalhostOnly, "only allow connections from localhost")
+	fs.Var(listValue{&flagCfg.Allow}, "allow", "comma separated networks (CIDR) clients may connect from")
+	fs.Var(listValue{&flagCfg.Deny}, "deny", "comma separated networks (CIDR) clients may not connect from")
+	fs.StringVar(&flagCfg.DataDir, "data-dir", flagCfg.DataDir, "directory for the database, certificates and the save file")
+	fs.StringVar(&flagCfg.HTMLDir, "html-dir", flagCfg.HTMLDir, "directory containing the web interface")
+	fs.StringVar(&flagCfg.CertFile, "cert-file", flagCfg.CertFile, "path to the TLS certificate (default <data-dir>/"+CFG_CERT_PREFIX+"cert.pem)")
+	fs.StringVar(&flagCfg.KeyFile, "key-file", flagCfg.KeyFile, "path to the TLS key (default <data-dir>/"+CFG_CERT_PREFIX+"key.pem)")
+	fs.StringVar(&flagCfg.SaveFile, "save-file", flagCfg.SaveFile, "path to the Tox save file (default <data-dir>/webtox_save)")
+	fs.StringVar(&flagCfg.SaveFile, "p", flagCfg.SaveFile, "shorthand for -save-file")
+	fs.StringVar(&flagCfg.DownloadDir, "download-dir", flagCfg.DownloadDir, "directory received files are stored in (default <data-dir>/downloads)")
+	fs.StringVar(&flagCfg.NodesFile, "nodes-file", flagCfg.NodesFile, "path to the list of bootstrap nodes in the nodes.tox.chat format (default <data-dir>/nodes.json)")
+	fs.DurationVar(&flagCfg.SaveInterval.Duration, "save-interval", flagCfg.SaveInterval.Duration, "interval for saving the Tox save file")
+	fs.IntVar(&flagCfg.SaveBackups, "save-backups", flagCfg.SaveBackups, "number of backups of the Tox save file to keep")
+	fs.Int64Var(&flagCfg.MaxRequestSize, "max-request-size", flagCfg.MaxRequestSize, "maximum size of an API request body in bytes")
+	fs.Int64Var(&flagCfg.MaxUploadSize, "max-upload-size", flagCfg.MaxUploadSize, "maximum size of a file sent from the web interface in bytes")
+	fs.Int64Var(&flagCfg.DownloadQuota, "download-quota", flagCfg.DownloadQuota, "maximum size of all received and sent files in bytes (0 for no limit)")
+	fs.Int64Var(&flagCfg.MaxFileSize, "max-file-size", flagCfg.MaxFileSize, "maximum size of a received file in bytes (0 for no limit)")
+	fs.DurationVar(&flagCfg.DownloadMaxAge.Duration, "download-max-age", flagCfg.DownloadMaxAge.Duration, "remove received and sent files after this long (0 to keep them)")
+	fs.BoolVar(&flagCfg.LowPower, "low-power", flagCfg.LowPower, "iterate less often while no web client is connected")
+	fs.DurationVar(&flagCfg.LowPowerInterval.Duration, "low-power-interval", flagCfg.LowPowerInterval.Duration, "iteration interval used in low-power mode")
+	fs.DurationVar(&flagCfg.SessionIdleTimeout.Duration, "session-idle-timeout", flagCfg.SessionIdleTimeout.Duration, "log out sessions that have not been used for this long")
+	fs.DurationVar(&flagCfg.SessionMaxAge.Duration, "session-max-age", flagCfg.SessionMaxAge.Duration, "log out sessions this long after the login")
+	fs.StringVar(&flagCfg.PasswordHash.Algorithm, "password-hash", flagCfg.PasswordHash.Algorithm, "algorithm used for hashing the GUI password (argon2id or bcrypt)")
+	fs.Var(uint32Value{&flagCfg.PasswordHash.Argon2Time}, "argon2-time", "argon2id iterations")
+	fs.Var(uint32Value{&flagCfg.PasswordHash.Argon2Memory}, "argon2-memory", "argon2id memory in KiB")
+	fs.Var(uint8Value{&flagCfg.PasswordHash.Argon2Threads}, "argon2-threads", "argon2id parallelism")
+	fs.IntVar(&flagCfg.PasswordHash.BcryptCost, "bcrypt-cost", flagCfg.PasswordHash.BcryptCost, "bcrypt cost")
+	fs.StringVar(&flagCfg.Passphrase, "passphrase", flagCfg.Passphrase, "passphrase used to encrypt the Tox save file (unsafe, it is visible to other users in the process list; use WEBTOX_PASSPHRASE or -passphrase-file instead)")
+	fs.StringVar(&flagCfg.PassphraseFile, "passphrase-file", flagCfg.PassphraseFile, "path to a file containing the passphrase used to encrypt the Tox save file")
+
+	fs.BoolVar(&flagCfg.DisableTOTP, "disable-2fa", flagCfg.DisableTOTP, "disable two-factor authentication for the web interface")
+
+	fs.BoolVar(&flagCfg.Tox.IPv6Enabled, "ipv6", flagCfg.Tox.IPv6Enabled, "enable IPv6")
+	fs.BoolVar(&flagCfg.Tox.UDPEnabled, "udp", flagCfg.Tox.UDPEnabled, "enable UDP")
+	fs.StringVar(&flagCfg.Tox.ProxyType, "proxy-type", flagCfg.Tox.ProxyType, "proxy type (NONE, HTTP or SOCKS5)")
+	fs.StringVar(&flagCfg.Tox.ProxyHost, "proxy-host", flagCfg.Tox.ProxyHost, "proxy host")
+	fs.IntVar(&flagCfg.Tox.ProxyPort, "proxy-port", flagCfg.Tox.ProxyPort, "proxy port")
+	fs.IntVar(&flagCfg.Tox.StartPort, "start-port", flagCfg.Tox.StartPort, "start of the Tox UDP port range (0 for default)")
+	fs.IntVar(&flagCfg.Tox.EndPort, "end-port", flagCfg.Tox.EndPort, "end of the Tox UDP port range (0 for default)")
+	fs.IntVar(&flagCfg.Tox.TCPPort, "tcp-port", flagCfg.Tox.TCPPort, "port of the Tox TCP relay server (0 to disable)")
+	fs.IntVar(&flagCfg.Tox.BootstrapCount, "bootstrap-count", flagCfg.Tox.BootstrapCount, "number of nodes to bootstrap against")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// remember the flags given on the command line, they are applied again
+	// whenever the configuration is (re)loaded
+	fs.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = f.Value.String()
+	})
+
+	if len(configFile) == 0 {
+		configFile = os.Getenv(envName("config"))
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg = c
+
+	if printConfig {
+		data, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+
+	return nil
+}
+
+// loadConfig assembles a new configuration from the defaults, the config
+// file, the environment and the command-line flags. It is used on startup and
+// when the configuration is reloaded.
+func loadConfig() (*Config, error) {
+	fs := flag.CommandLine
+
+	*flagCfg = *defaultConfig()
+	if len(configFile) != 0 {
+		if err := readConfigFile(configFile, flagCfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %s", configFile, err)
+		}
+	}
+
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := cmdlineFlags[f.Name]; ok || len(f.Name) == 1 || f.Name == "config" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", envName(f.Name), err))
+			}
+		}
+	})
+	for name, value := range cmdlineFlags {
+		fs.Set(name, value)
+	}
+	if len(errs) != 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	c := *flagCfg
+	c.resolvePaths()
+
+	// listen_address is only used if listen_addresses is not set
+	if len(c.ListenAddresses) == 0 {
+		c.ListenAddresses = []string{c.ListenAddress}
+	}
+	c.ListenAddress = ""
+
+	// listen on the loopback interface instead of all interfaces
+	if c.LocalhostOnly {
+		addresses := make([]string, len(c.ListenAddresses))
+		for i, address := range c.ListenAddresses {
+			addresses[i] = loopbackAddress(address)
+		}
+		c.ListenAddresses = addresses
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(c.Passphrase) == 0 && len(c.PassphraseFile) != 0 {
+		data, err := ioutil.ReadFile(c.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase_file: %s", err)
+		}
+		c.Passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return &c, nil
+}
+
+// envName returns the name of the environment variable for a flag
+// name  the name of the flag
+func envName(name string) string {
+	return CFG_ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readConfigFile reads a JSON config file into c. Relative paths in the config
+// file are relative to the directory of the config file.
+// path  the path to the config file
+// c     the config to be updated
+func readConfigFile(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fileCfg = *c
+	fileCfg.DataDir, fileCfg.HTMLDir = "", ""
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&fileCfg); err != nil {
+		return err
+	}
+
+	base := filepath.Dir(path)
+	for _, p := range []*string{&fileCfg.DataDir, &fileCfg.HTMLDir, &fileCfg.CertFile, &fileCfg.KeyFile, &fileCfg.SaveFile, &fileCfg.NodesFile, &fileCfg.DownloadDir, &fileCfg.PassphraseFile} {
+		if len(*p) != 0 && !filepath.IsAbs(*p) {
+			*p = filepath.Join(base, *p)
+		}
+	}
+
+	if len(fileCfg.DataDir) == 0 {
+		fileCfg.DataDir = c.DataDir
+	}
+	if len(fileCfg.HTMLDir) == 0 {
+		fileCfg.HTMLDir = c.HTMLDir
+	}
+
+	*c = fileCfg
+	return nil
+}
+
+// resolvePaths fills in the paths that default to files in the data directory
+func (c *Config) resolvePaths() {
+	if len(c.CertFile) == 0 {
+		c.CertFile = filepath.Join(c.DataDir, CFG_CERT_PREFIX+"cert.pem")
+	}
+	if len(c.KeyFile) == 0 {
+		c.KeyFile = filepath.Join(c.DataDir, CFG_CERT_PREFIX+"key.pem")
+	}
+	if len(c.SaveFile) == 0 {
+		c.SaveFile = filepath.Join(c.DataDir, "webtox_save")
+	}
+	if len(c.NodesFile) == 0 {
+		c.NodesFile = filepath.Join(c.DataDir, "nodes.json")
+	}
+	if len(c.DownloadDir) == 0 {
+		c.DownloadDir = filepath.Join(c.DataDir, "downloads")
+	}
+}
+
+// validate checks the configuration and returns an error describing every
+// invalid setting
+func (c *Config) validate() error {
+	var errs []string
+
+	for _, address := range c.ListenAddresses {
+		if path := strings.TrimPrefix(address, "unix:"); path != address {
+			if len(path) == 0 {
+				errs = append(errs, "listen_addresses: empty Unix socket path")
+			}
+		} else if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Sprintf("listen_addresses: %s", err))
+		} else if c.LocalhostOnly && !isLoopbackAddress(address) {
+			errs = append(errs, fmt.Sprintf("listen_addresses: %s is not a loopback address, but localhost_only is set", address))
+		}
+	}
+
+	if _, err := parseNetworks(c.Allow); err != nil {
+		errs = append(errs, fmt.Sprintf("allow: %s", err))
+	}
+
+	if _, err := parseNetworks(c.Deny); err != nil {
+		errs = append(errs, fmt.Sprintf("deny: %s", err))
+	}
+
+	if info, err := os.Stat(c.DataDir); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Sprintf("data_dir: %s is not a directory", c.DataDir))
+	}
+
+	if exists, _ := fileExists(filepath.Join(c.HTMLDir, "index.html")); !exists {
+		errs = append(errs, fmt.Sprintf("html_dir: %s does not contain index.html", c.HTMLDir))
+	}
+
+	if c.SaveInterval.Duration < time.Second {
+		errs = append(errs, "save_interval: must be at least 1s")
+	}
+
+	if c.SaveBackups < 0 {
+		errs = append(errs, "save_backups: must not be negative")
+	}
+
+	if c.MaxRequestSize <= 0 {
+		errs = append(errs, "max_request_size: must be positive")
+	}
+
+	if c.MaxUploadSize <= 0 {
+		errs = append(errs, "max_upload_size: must be positive")
+	}
+
+	if c.DownloadQuota < 0 {
+		errs = append(errs, "download_quota: must not be negative")
+	}
+
+	if c.MaxFileSize < 0 {
+		errs = append(errs, "max_file_size: must not be negative")
+	}
+
+	if c.DownloadMaxAge.Duration < 0 {
+		errs = append(errs, "download_max_age: must not be negative")
+	}
+
+	if c.LowPowerInterval.Duration <= 0 || c.LowPowerInterval.Duration > 5*time.Second {
+		errs = append(errs, "low_power_interval: must be between 0 and 5s")
+	}
+
+	if c.SessionIdleTimeout.Duration < time.Minute {
+		errs = append(errs, "session_idle_timeout: must be at least 1m")
+	}
+
+	if c.SessionMaxAge.Duration < c.SessionIdleTimeout.Duration {
+		errs = append(errs, "session_max_age: must not be shorter than session_idle_timeout")
+	}
+
+	errs = append(errs, c.PasswordHash.validate()...)
+	errs = append(errs, c.Tox.validate()...)
+
+	if len(errs) != 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// validate checks the Tox network configuration and returns a description of
+// every invalid setting
+func (c *ToxConfig) validate() []string {
+	var errs []string
+
+	if _, err := getProxyTypeFromString(c.ProxyType); err != nil {
+		errs = append(errs, fmt.Sprintf("tox.proxy_type: %s", err))
+	} else if strings.ToUpper(c.ProxyType) != "NONE" && len(c.ProxyHost) == 0 {
+		errs = append(errs, "tox.proxy_host: required if a proxy is used")
+	}
+
+	ports := map[string]int{
+		"tox.proxy_port": c.ProxyPort,
+		"tox.start_port": c.StartPort,
+		"tox.end_port":   c.EndPort,
+		"tox.tcp_port":   c.TCPPort,
+	}
+	for name, port := range ports {
+		if port < 0 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("%s: %d is not a valid port", name, port))
+		}
+	}
+
+	if c.StartPort > c.EndPort {
+		errs = append(errs, "tox.start_port: must not be greater than tox.end_port")
+	}
+
+	if c.BootstrapCount < 1 {
+		errs = append(errs, "tox.bootstrap_count: must be at least 1")
+	}
+
+	for i, node := range c.BootstrapNodes {
+		if !node.isUsable() || len(node.addresses(true)) == 0 {
+			errs = append(errs, fmt.Sprintf("tox.bootstrap_nodes[%d]: invalid node", i))
+		}
+	}
+
+	return errs
+}
+
+// loadToxSettings overrides the Tox network configuration with the settings
+// changed in the web interface (stored in the database)
+// c  the Tox network configuration to be updated
+func loadToxSettings(c *ToxConfig) {
+	if value, err := storage.GetKeyValue("settings_tox_ipv6_enabled"); err == nil {
+		c.IPv6Enabled, _ = strconv.ParseBool(value)
+	}
+	if value, err := storage.GetKeyValue("settings_tox_udp_enabled"); err == nil {
+		c.UDPEnabled, _ = strconv.ParseBool(value)
+	}
+	if value, err := storage.GetKeyValue("settings_tox_proxy_type"); err == nil {
+		c.ProxyType = value
+	}
+	if value, err := storage.GetKeyValue("settings_tox_proxy_host"); err == nil {
+		c.ProxyHost = value
+	}
+	if value, err := storage.GetKeyValue("settings_tox_proxy_port"); err == nil {
+		c.ProxyPort, _ = strconv.Atoi(value)
+	}
+	if value, err := storage.GetKeyValue("settings_tox_start_port"); err == nil {
+		c.StartPort, _ = strconv.Atoi(value)
+	}
+	if value, err := storage.GetKeyValue("settings_tox_end_port"); err == nil {
+		c.EndPort, _ = strconv.Atoi(value)
+	}
+}
+
+// storeToxSettings stores the Tox network settings that can be changed in the
+// web interface in the database
+// c  the Tox network configuration
+func storeToxSettings(c *ToxConfig) error {
+	settings := map[string]string{
+		"settings_tox_ipv6_enabled": strconv.FormatBool(c.IPv6Enabled),
+		"settings_tox_udp_enabled":  strconv.FormatBool(c.UDPEnabled),
+		"settings_tox_proxy_type":   strings.ToUpper(c.ProxyType),
+		"settings_tox_proxy_host":   c.ProxyHost,
+		"settings_tox_proxy_port":   strconv.Itoa(c.ProxyPort),
+		"settings_tox_start_port":   strconv.Itoa(c.StartPort),
+		"settings_tox_end_port":     strconv.Itoa(c.EndPort),
+	}
+
+	for key, value := range settings {
+		if err := storage.StoreKeyValue(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The encrypted savedata format is compatible with toxencryptsave as used by
+// qTox, uTox and other clients:
+//
+//	magic (8) | salt (32) | nonce (24) | MAC (16) | encrypted savedata
+const (
+	ENCRYPTSAVE_MAGIC        string = "toxEsave"
+	ENCRYPTSAVE_SALT_LENGTH  int    = 32
+	ENCRYPTSAVE_NONCE_LENGTH int    = 24
+	ENCRYPTSAVE_KEY_LENGTH   int    = 32
+	ENCRYPTSAVE_EXTRA_LENGTH int    = len(ENCRYPTSAVE_MAGIC) + ENCRYPTSAVE_SALT_LENGTH + ENCRYPTSAVE_NONCE_LENGTH + secretbox.Overhead
+)
+
+// scrypt parameters used by toxencryptsave (libsodium's
+// OPSLIMIT_INTERACTIVE*2 and MEMLIMIT_INTERACTIVE translate to N=2^14, r=8, p=2)
+const (
+	encryptsaveScryptN int = 16384
+	encryptsaveScryptR int = 8
+	encryptsaveScryptP int = 2
+)
+
+var (
+	ErrNotEncrypted    = errors.New("Data is not encrypted")
+	ErrWrongPassphrase = errors.New("Wrong passphrase or corrupted data")
+)
+
+// passKey is a key derived from a passphrase together with the salt used to
+// derive it
+type passKey struct {
+	salt [ENCRYPTSAVE_SALT_LENGTH]byte
+	key  [ENCRYPTSAVE_KEY_LENGTH]byte
+}
+
+// isDataEncrypted returns true if data starts with the toxencryptsave magic
+// data  the (possibly encrypted) savedata
+func isDataEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ENCRYPTSAVE_MAGIC))
+}
+
+// newPassKey derives a key from a passphrase using a new random salt
+// passphrase  the passphrase
+func newPassKey(passphrase string) (*passKey, error) {
+	var salt [ENCRYPTSAVE_SALT_LENGTH]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, err
+	}
+
+	return derivePassKey(passphrase, salt[:])
+}
+
+// derivePassKey derives a key from a passphrase and the given salt
+// passphrase  the passphrase
+// salt        the salt (ENCRYPTSAVE_SALT_LENGTH bytes)
+func derivePassKey(passphrase string, salt []byte) (*passKey, error) {
+	if len(salt) != ENCRYPTSAVE_SALT_LENGTH {
+		return nil, errors.New("Invalid salt length")
+	}
+
+	// toxencryptsave hashes the passphrase before running scrypt on it
+	passhash := sha256.Sum256([]byte(passphrase))
+
+	key, err := scrypt.Key(passhash[:], salt, encryptsaveScryptN, encryptsaveScryptR, encryptsaveScryptP, ENCRYPTSAVE_KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	pk := &passKey{}
+	copy(pk.salt[:], salt)
+	copy(pk.key[:], key)
+	return pk, nil
+}
+
+// encryptData encrypts data with the given key using a new random nonce
+// pk    the key to use for encryption
+// data  the plaintext savedata
+func encryptData(pk *passKey, data []byte) ([]byte, error) {
+	var nonce [ENCRYPTSAVE_NONCE_LENGTH]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(data)+ENCRYPTSAVE_EXTRA_LENGTH)
+	out = append(out, ENCRYPTSAVE_MAGIC...)
+	out = append(out, pk.salt[:]...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, data, &nonce, &pk.key), nil
+}
+
+// decryptData decrypts toxencryptsave-encrypted data with the given passphrase
+// and returns the plaintext together with the derived key so it can be reused
+// for encrypting the data again
+// passphrase  the passphrase
+// data        the encrypted savedata
+func decryptData(passphrase string, data []byte) ([]byte, *passKey, error) {
+	if !isDataEncrypted(data) {
+		return nil, nil, ErrNotEncrypted
+	}
+
+	if len(data) < ENCRYPTSAVE_EXTRA_LENGTH {
+		return nil, nil, ErrWrongPassphrase
+	}
+
+	data = data[len(ENCRYPTSAVE_MAGIC):]
+	pk, err := derivePassKey(passphrase, data[:ENCRYPTSAVE_SALT_LENGTH])
+	if err != nil {
+		return nil, nil, err
+	}
+	data = data[ENCRYPTSAVE_SALT_LENGTH:]
+
+	var nonce [ENCRYPTSAVE_NONCE_LENGTH]byte
+	copy(nonce[:], data[:ENCRYPTSAVE_NONCE_LENGTH])
+	data = data[ENCRYPTSAVE_NONCE_LENGTH:]
+
+	plain, ok := secretbox.Open(nil, data, &nonce, &pk.key)
+	if !ok {
+		return nil, nil, ErrWrongPassphrase
+	}
+
+	return plain, pk, nil
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/codedust/go-tox"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Incoming data files are held in a pending state until the user accepts or
+// rejects them, unless an auto-accept rule matches. The rules are stored as
+// JSON in the keyValue settings_auto_accept. Outgoing files are staged in the
+// download directory and read from there when toxcore requests chunks.
+//
+// Accepted incoming files are remembered with the file ID chosen by the
+// sender and the number of bytes received (see persistence.Transfer). If the
+// friend goes offline or WebTox is restarted, the incomplete file is kept and
+// the transfer continues at the stored position when the friend offers the
+// file with the same file ID again.
+
+// the states of a file transfer
+const (
+	TRANSFER_PENDING string = "pending" // waiting to be accepted
+	TRANSFER_RUNNING string = "running"
+	TRANSFER_PAUSED  string = "paused" // by us, the friend or both
+	TRANSFER_DONE    string = "done"
+	TRANSFER_FAILED  string = "failed" // cancelled or aborted
+
+	// the friend went offline, the transfer is resumed when the file is
+	// offered again
+	TRANSFER_INTERRUPTED string = "interrupted"
+)
+
+var (
+	ErrTransferNotFound     = errors.New("File transfer does not exist")
+	ErrInvalidTransferState = errors.New("The file transfer cannot be changed in its current state")
+)
+
+// autoAcceptRule accepts files from a friend (or from all friends if PublicKey
+// is empty) that are not larger than MaxSize bytes
+type autoAcceptRule struct {
+	PublicKey string `json:"publicKey"`
+	MaxSize   uint64 `json:"max_size"`
+}
+
+// transferInfo describes an active file transfer
+type transferInfo struct {
+	Friend         uint32  `json:"friend"`
+	PublicKey      string  `json:"publicKey"`
+	File           uint32  `json:"file"`
+	ID             int64   `json:"id"`
+	Name           string  `json:"name"`
+	Size           uint64  `json:"size"`
+	Position       uint64  `json:"position"`
+	Rate           float64 `json:"rate"`
+	IsIncoming     bool    `json:"isIncoming"`
+	State          string  `json:"state"`
+	PausedByUs     bool    `json:"paused_by_us"`
+	PausedByFriend bool    `json:"paused_by_friend"`
+}
+
+// getAutoAcceptRules returns the stored auto-accept rules
+func getAutoAcceptRules() []autoAcceptRule {
+	rules := []autoAcceptRule{}
+	data, err := storage.GetKeyValue("settings_auto_accept")
+	if err == nil && len(data) != 0 {
+		json.Unmarshal([]byte(data), &rules)
+	}
+	return rules
+}
+
+// storeAutoAcceptRules replaces the auto-accept rules
+// rules  the new rules
+func storeAutoAcceptRules(rules []autoAcceptRule) error {
+	for i := range rules {
+		rules[i].PublicKey = strings.ToUpper(rules[i].PublicKey)
+		if len(rules[i].PublicKey) != 0 {
+			if publicKey, err := hex.DecodeString(rules[i].PublicKey); err != nil || len(publicKey) != gotox.TOX_PUBLIC_KEY_SIZE {
+				return errors.New("Invalid public key: " + rules[i].PublicKey)
+			}
+		}
+		if rules[i].MaxSize == 0 {
+			return errors.New("The maximum size must be greater than 0")
+		}
+	}
+
+	rulesJSON, _ := json.Marshal(rules)
+	return storage.StoreKeyValue("settings_auto_accept", string(rulesJSON))
+}
+
+// shouldAutoAccept returns true if a file is accepted by an auto-accept rule
+// publicKey  the public key of the friend sending the file
+// size       the size of the file
+func shouldAutoAccept(publicKey []byte, size uint64) bool {
+	key := strings.ToUpper(hex.EncodeToString(publicKey))
+	for _, rule := range getAutoAcceptRules() {
+		if (len(rule.PublicKey) == 0 || rule.PublicKey == key) && size <= rule.MaxSize {
+			return true
+		}
+	}
+	return false
+}
+
+// transferKey identifies a file transfer. toxcore file numbers are only
+// unique per friend, and friend numbers are reused after a friend has been
+// deleted, so the public key of the friend is used.
+type transferKey struct {
+	publicKey  string
+	fileNumber uint32
+}
+
+// transferTable holds the active file transfers. The table itself may be used
+// concurrently, but transfers are only changed from the main loop, so a
+// transfer read with get is not changed by anyone else before it is set.
+type transferTable struct {
+	sync.Mutex
+	m map[transferKey]FileTransfer
+}
+
+// newTransferTable returns an empty transferTable
+func newTransferTable() *transferTable {
+	return &transferTable{m: make(map[transferKey]FileTransfer)}
+}
+
+// get returns the transfer with the given key
+func (tt *transferTable) get(key transferKey) (FileTransfer, bool) {
+	tt.Lock()
+	defer tt.Unlock()
+	transfer, ok := tt.m[key]
+	return transfer, ok
+}
+
+// set adds or replaces a transfer
+func (tt *transferTable) set(key transferKey, transfer FileTransfer) {
+	tt.Lock()
+	defer tt.Unlock()
+	tt.m[key] = transfer
+}
+
+// remove removes a transfer
+func (tt *transferTable) remove(key transferKey) {
+	tt.Lock()
+	defer tt.Unlock()
+	delete(tt.m, key)
+}
+
+// snapshot returns a copy of the table, so it can be iterated while the
+// transfers are changed
+func (tt *transferTable) snapshot() map[transferKey]FileTransfer {
+	tt.Lock()
+	defer tt.Unlock()
+	m := make(map[transferKey]FileTransfer, len(tt.m))
+	for key, transfer := range tt.m {
+		m[key] = transfer
+	}
+	return m
+}
+
+// friendPublicKey returns the public key of a friend. Tests replace it to
+// simulate friends without a Tox instance.
+var friendPublicKey = func(t *gotox.Tox, friendnumber uint32) ([]byte, error) {
+	return t.FriendGetPublickey(friendnumber)
+}
+
+// friendTransferKey returns the key of a transfer of a friend. Must only be
+// called from the main loop.
+// t             the Tox instance
+// friendnumber  the friend
+// filenumber    the file number of the transfer
+func friendTransferKey(t *gotox.Tox, friendnumber uint32, filenumber uint32) (transferKey, error) {
+	publicKey, err := friendPublicKey(t, friendnumber)
+	if err != nil {
+		return transferKey{}, err
+	}
+	return transferKey{publicKey: hex.EncodeToString(publicKey), fileNumber: filenumber}, nil
+}
+
+// newTransferInfo describes a transfer
+// key       the key of the transfer
+// transfer  the transfer
+func newTransferInfo(key transferKey, transfer FileTransfer) transferInfo {
+	return transferInfo{
+		Friend:         transfer.friendNumber,
+		PublicKey:      key.publicKey,
+		File:           key.fileNumber,
+		ID:             transfer.fileID,
+		Name:           transfer.fileName,
+		Size:           transfer.fileSize,
+		Position:       transfer.position,
+		Rate:           transfer.rate,
+		IsIncoming:     !transfer.outgoing,
+		State:          transfer.state,
+		PausedByUs:     transfer.pausedByUs,
+		PausedByFriend: transfer.pausedByFriend,
+	}
+}
+
+// listTransfers returns the active data file transfers
+func listTransfers() []transferInfo {
+	list := []transferInfo{}
+	for key, transfer := range transfers.snapshot() {
+		if transfer.fileKind == gotox.TOX_FILE_KIND_DATA {
+			list = append(list, newTransferInfo(key, transfer))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// getTransfer returns an active data file transfer. Must only be called from
+// the main loop.
+// key  the key of the transfer
+func getTransfer(key transferKey) (FileTransfer, error) {
+	transfer, ok := transfers.get(key)
+	if !ok || transfer.fileKind != gotox.TOX_FILE_KIND_DATA {
+		return FileTransfer{}, ErrTransferNotFound
+	}
+	return transfer, nil
+}
+
+// getPendingTransfer returns an incoming data file transfer that has not been
+// accepted yet. Must only be called from the main loop.
+// key  the key of the transfer
+func getPendingTransfer(key transferKey) (FileTransfer, error) {
+	transfer, err := getTransfer(key)
+	if err != nil || transfer.outgoing || transfer.state != TRANSFER_PENDING {
+		return FileTransfer{}, ErrTransferNotFound
+	}
+	return transfer, nil
+}
+
+// acceptTransfer accepts an incoming file. Must only be called from the main
+// loop.
+// t     the Tox instance
+// key   the key of the transfer
+// name  the name to save the file as (empty to keep the name)
+func acceptTransfer(t *gotox.Tox, key transferKey, name string) error {
+	transfer, err := getPendingTransfer(key)
+	if err != nil {
+		return err
+	}
+
+	// offers do not count towards the quota until they are accepted
+	if err = checkDownloadQuota(transfer.fileSize); err != nil {
+		return err
+	}
+
+	if len(name) != 0 {
+		transfer.fileName = sanitizeFilename(name)
+		if err = storage.RenameFile(transfer.fileID, transfer.fileName); err != nil {
+			return err
+		}
+	}
+
+	if err = t.FileControl(transfer.friendNumber, key.fileNumber, gotox.TOX_FILE_CONTROL_RESUME); err != nil {
+		return err
+	}
+
+	if len(transfer.toxFileID) != 0 {
+		storage.StoreTransfer(transfer.fileID, transfer.toxFileID)
+	}
+
+	transfer.state = TRANSFER_RUNNING
+	transfers.set(key, notifyTransfer(key, transfer, true))
+	log.Println("[fileTransfers] Accepted file", transfer.fileID)
+	return nil
+}
+
+// resumeFile continues receiving an incomplete file that has been accepted
+// before. Returns false if the file is not known and has to be offered to the
+// user. Must only be called from the main loop.
+// t             the Tox instance
+// key           the key of the transfer
+// friendnumber  the friend offering the file
+// toxFileID     the file ID chosen by the sender (hex encoded)
+// size          the size of the file
+func resumeFile(t *gotox.Tox, key transferKey, friendnumber uint32, toxFileID string, size uint64) bool {
+	// toxcore may notice that the friend went offline after we did
+	for oldKey, transfer := range transfers.snapshot() {
+		if oldKey.publicKey != key.publicKey || transfer.toxFileID != toxFileID {
+			continue
+		}
+
+		if isResumable(transfer) {
+			finishTransfer(oldKey, transfer, TRANSFER_INTERRUPTED)
+		} else {
+			finishTransfer(oldKey, transfer, TRANSFER_FAILED)
+		}
+	}
+
+	f, err := storage.GetTransfer(key.publicKey, toxFileID)
+	if err != nil || !f.IsIncoming || f.Size != size {
+		return false
+	}
+
+	file, err := os.OpenFile(filepath.Join(cfg.DownloadDir, filepath.Base(f.StoredName)), os.O_RDWR, 0600)
+	if err != nil {
+		log.Println("[fileTransfers] Opening incomplete file failed:", err)
+		return false
+	}
+
+	// data after the stored position may not have been written completely
+	position := f.Position
+	if info, err := file.Stat(); err != nil || uint64(info.Size()) < position {
+		position = 0
+	}
+
+	if position != 0 {
+		if err = t.FileSeek(friendnumber, key.fileNumber, position); err != nil {
+			log.Println("[fileTransfers] Seeking failed, starting over:", err)
+			position = 0
+		}
+	}
+
+	transfers.set(key, FileTransfer{friendNumber: friendnumber, fileHandle: file, fileSize: size, fileKind: gotox.TOX_FILE_KIND_DATA, fileID: f.ID, fileName: f.FileName, toxFileID: toxFileID, state: TRANSFER_PENDING, position: position, lastPosition: position})
+	if err = acceptTransfer(t, key, ""); err != nil {
+		transfers.remove(key)
+		file.Close()
+		return false
+	}
+
+	log.Println("[fileTransfers] Resuming file", f.ID, "at", position)
+	return true
+}
+
+// isResumable returns true if a transfer is kept when it is interrupted
+// transfer  the transfer
+func isResumable(transfer FileTransfer) bool {
+	return !transfer.outgoing && len(transfer.toxFileID) != 0 && transfer.state != TRANSFER_PENDING
+}
+
+// saveTransferPosition stores the number of bytes received of a resumable
+// transfer. Unless force is set, the position is stored at most every
+// CFG_TRANSFER_SAVE_INTERVAL. Returns the updated transfer.
+// transfer  the transfer
+// force     store the position even if it was stored recently
+func saveTransferPosition(transfer FileTransfer, force bool) FileTransfer {
+	if !isResumable(transfer) || (!force && time.Since(transfer.lastSaved) < CFG_TRANSFER_SAVE_INTERVAL) {
+		return transfer
+	}
+
+	// the data up to the position has to be on disk before the position is
+	// stored, otherwise a crash leaves holes in the resumed file
+	if err := transfer.fileHandle.Sync(); err != nil {
+		log.Println("[fileTransfers] Syncing file", transfer.fileID, "failed:", err)
+		return transfer
+	}
+
+	storage.SetTransferPosition(transfer.fileID, transfer.position)
+	transfer.lastSaved = time.Now()
+	return transfer
+}
+
+// rejectTransfer rejects an incoming file. Must only be called from the main
+// loop.
+// t    the Tox instance
+// key  the key of the transfer
+func rejectTransfer(t *gotox.Tox, key transferKey) error {
+	if _, err := getPendingTransfer(key); err != nil {
+		return err
+	}
+	return cancelTransfer(t, key)
+}
+
+// pauseTransfer pauses a running file transfer. Must only be called from the
+// main loop.
+// t    the Tox instance
+// key  the key of the transfer
+func pauseTransfer(t *gotox.Tox, key transferKey) error {
+	transfer, err := getTransfer(key)
+	if err != nil {
+		return err
+	}
+	if transfer.state == TRANSFER_PENDING || transfer.pausedByUs {
+		return ErrInvalidTransferState
+	}
+
+	if err = t.FileControl(transfer.friendNumber, key.fileNumber, gotox.TOX_FILE_CONTROL_PAUSE); err != nil {
+		return err
+	}
+
+	transfer.pausedByUs = true
+	transfers.set(key, notifyTransfer(key, updateTransferState(transfer), true))
+	return nil
+}
+
+// resumeTransfer resumes a file transfer paused by pauseTransfer. Must only be
+// called from the main loop.
+// t    the Tox instance
+// key  the key of the transfer
+func resumeTransfer(t *gotox.Tox, key transferKey) error {
+	transfer, err := getTransfer(key)
+	if err != nil {
+		return err
+	}
+	if !transfer.pausedByUs {
+		return ErrInvalidTransferState
+	}
+
+	if err = t.FileControl(transfer.friendNumber, key.fileNumber, gotox.TOX_FILE_CONTROL_RESUME); err != nil {
+		return err
+	}
+
+	transfer.pausedByUs = false
+	transfers.set(key, notifyTransfer(key, updateTransferState(transfer), true))
+	return nil
+}
+
+// cancelTransfer cancels a file transfer in any state and removes the
+// incomplete file. Must only be called from the main loop.
+// t    the Tox instance
+// key  the key of the transfer
+func cancelTransfer(t *gotox.Tox, key transferKey) error {
+	transfer, err := getTransfer(key)
+	if err != nil {
+		return err
+	}
+
+	// the transfer is removed even if the friend is not reachable anymore
+	t.FileControl(transfer.friendNumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+	finishTransfer(key, transfer, TRANSFER_FAILED)
+	log.Println("[fileTransfers] Cancelled file", transfer.fileID)
+	return nil
+}
+
+// updateTransferState derives the state of an accepted transfer from who
+// paused it
+// transfer  the transfer
+func updateTransferState(transfer FileTransfer) FileTransfer {
+	if transfer.state == TRANSFER_PENDING {
+		return transfer
+	}
+
+	if transfer.pausedByUs || transfer.pausedByFriend {
+		transfer.state = TRANSFER_PAUSED
+		transfer.rate = 0
+	} else {
+		transfer.state = TRANSFER_RUNNING
+	}
+	return transfer
+}
+
+// finishTransfer removes a transfer that is done, failed or interrupted and
+// notifies the clients. The files of failed transfers are removed. Must only
+// be called from the main loop.
+// key       the key of the transfer
+// transfer  the transfer
+// state     TRANSFER_DONE, TRANSFER_FAILED or TRANSFER_INTERRUPTED
+func finishTransfer(key transferKey, transfer FileTransfer, state string) {
+	transfers.remove(key)
+
+	switch state {
+	case TRANSFER_DONE:
+		transfer.fileHandle.Sync()
+		transfer.fileHandle.Close()
+	case TRANSFER_INTERRUPTED:
+		saveTransferPosition(transfer, true)
+		transfer.fileHandle.Close()
+		log.Println("[fileTransfers] Interrupted file", transfer.fileID, "at", transfer.position)
+	default:
+		removeIncompleteFile(transfer)
+	}
+
+	if transfer.fileKind != gotox.TOX_FILE_KIND_DATA {
+		return
+	}
+
+	transfer.state = state
+	transfer.rate = 0
+	notifyTransfer(key, transfer, true)
+
+	broadcastToClients(createSimpleJSONEvent("transfers_update"))
+	if state == TRANSFER_FAILED {
+		broadcastToClients(createSimpleJSONEvent("friendlist_update"))
+	}
+}
+
+// sendFile offers a file to a friend. The file is sent when the friend accepts
+// it (see onFileChunkRequest). Must only be called from the main loop.
+// t         the Tox instance
+// transfer  the outgoing transfer
+func sendFile(t *gotox.Tox, transfer FileTransfer) (uint32, error) {
+	key, err := friendTransferKey(t, transfer.friendNumber, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	key.fileNumber, err = t.FileSend(transfer.friendNumber, gotox.TOX_FILE_KIND_DATA, transfer.fileSize, nil, transfer.fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	transfer.state = TRANSFER_PENDING
+	transfers.set(key, transfer)
+	return key.fileNumber, nil
+}
+
+// notifyTransfer updates the transfer rate and sends a transfer_progress
+// event. Unless force is set, events are sent at most every
+// CFG_PROGRESS_INTERVAL. Returns the updated transfer. Must only be called
+// from the main loop.
+// key       the key of the transfer
+// transfer  the transfer
+// force     send the event even if the last one was sent recently
+func notifyTransfer(key transferKey, transfer FileTransfer, force bool) FileTransfer {
+	if transfer.fileKind != gotox.TOX_FILE_KIND_DATA {
+		return transfer
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(transfer.lastProgress)
+	if !force && elapsed < CFG_PROGRESS_INTERVAL {
+		return transfer
+	}
+
+	if transfer.state == TRANSFER_RUNNING && !transfer.lastProgress.IsZero() && elapsed > 0 {
+		rate := float64(transfer.position-transfer.lastPosition) / elapsed.Seconds()
+		if transfer.rate == 0 {
+			transfer.rate = rate
+		} else {
+			// smooth the rate, chunks do not arrive evenly
+			transfer.rate = 0.7*transfer.rate + 0.3*rate
+		}
+	}
+	transfer.lastPosition = transfer.position
+	transfer.lastProgress = now
+
+	type jsonEvent struct {
+		Type string `json:"type"`
+		transferInfo
+	}
+
+	e, _ := json.Marshal(jsonEvent{Type: "transfer_progress", transferInfo: newTransferInfo(key, transfer)})
+	broadcastToClients(string(e))
+	return transfer
+}
+
+// dropFriendTransfers removes the transfers of a friend that went offline or
+// has been deleted (toxcore cancels them without calling the callbacks).
+// Accepted incoming files of a friend that went offline are kept to be
+// resumed. Must only be called from the main loop.
+// publicKey  the public key of the friend
+// deleted    true if the friend has been deleted
+func dropFriendTransfers(publicKey []byte, deleted bool) {
+	for key, transfer := range transfers.snapshot() {
+		if key.publicKey != hex.EncodeToString(publicKey) {
+			continue
+		}
+
+		if !deleted && isResumable(transfer) {
+			finishTransfer(key, transfer, TRANSFER_INTERRUPTED)
+		} else {
+			finishTransfer(key, transfer, TRANSFER_FAILED)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/codedust/go-tox"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testFriends maps the friend numbers of simulated friends to their public
+// keys
+var testFriends = map[uint32][]byte{
+	0: bytes.Repeat([]byte{0xAA}, gotox.TOX_PUBLIC_KEY_SIZE),
+	1: bytes.Repeat([]byte{0xBB}, gotox.TOX_PUBLIC_KEY_SIZE),
+}
+
+// setupTransferTest replaces the transfer table and simulates the friends in
+// testFriends. The returned function restores the previous state.
+func setupTransferTest(t *testing.T) func() {
+	oldTransfers, oldFriendPublicKey := transfers, friendPublicKey
+	transfers = newTransferTable()
+	friendPublicKey = func(_ *gotox.Tox, friendnumber uint32) ([]byte, error) {
+		publicKey, ok := testFriends[friendnumber]
+		if !ok {
+			return nil, errors.New("friend not found")
+		}
+		return publicKey, nil
+	}
+
+	return func() {
+		transfers, friendPublicKey = oldTransfers, oldFriendPublicKey
+	}
+}
+
+// addTestTransfer adds an accepted incoming transfer of a simulated friend
+// writing to a new temporary file
+func addTestTransfer(t *testing.T, friendnumber uint32, filenumber uint32, size uint64) transferKey {
+	file, err := ioutil.TempFile(t.TempDir(), "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	key := transferKey{publicKey: hex.EncodeToString(testFriends[friendnumber]), fileNumber: filenumber}
+	transfers.set(key, FileTransfer{friendNumber: friendnumber, fileHandle: file, fileSize: size, fileKind: gotox.TOX_FILE_KIND_DATA, state: TRANSFER_RUNNING})
+	return key
+}
+
+func TestOnFileRecvChunkInterleavedFriends(t *testing.T) {
+	defer setupTransferTest(t)()
+
+	// both friends send file number 0 and 1, the files are larger than the
+	// data sent, so the transfers stay active
+	const size = 100
+	keys := map[[2]uint32]transferKey{}
+	want := map[[2]uint32][]byte{}
+	for friend := range testFriends {
+		for file := uint32(0); file < 2; file++ {
+			keys[[2]uint32{friend, file}] = addTestTransfer(t, friend, file, size)
+		}
+	}
+
+	for position := uint64(0); position < 40; position += 8 {
+		for friend := range testFriends {
+			for file := uint32(0); file < 2; file++ {
+				chunk := bytes.Repeat([]byte{byte('a' + 2*friend + file)}, 8)
+				onFileRecvChunk(nil, friend, file, position, chunk)
+
+				id := [2]uint32{friend, file}
+				want[id] = append(want[id], chunk...)
+			}
+		}
+	}
+
+	// a chunk from an unknown friend must not end up in any file
+	onFileRecvChunk(nil, 2, 0, 40, []byte("unknown"))
+
+	if n := len(transfers.snapshot()); n != len(keys) {
+		t.Fatalf("%d transfers in the table, want %d", n, len(keys))
+	}
+
+	for id, key := range keys {
+		transfer, ok := transfers.get(key)
+		if !ok {
+			t.Errorf("transfer %v is missing", id)
+			continue
+		}
+		if transfer.friendNumber != id[0] {
+			t.Errorf("transfer %v belongs to friend %d", id, transfer.friendNumber)
+		}
+		if transfer.position != uint64(len(want[id])) {
+			t.Errorf("transfer %v is at position %d, want %d", id, transfer.position, len(want[id]))
+		}
+
+		data, err := ioutil.ReadFile(transfer.fileHandle.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want[id]) {
+			t.Errorf("file %v contains %q, want %q", id, data, want[id])
+		}
+	}
+}
+
+func TestDropFriendTransfers(t *testing.T) {
+	defer setupTransferTest(t)()
+
+	deleted := addTestTransfer(t, 0, 0, 100)
+	kept := addTestTransfer(t, 1, 0, 100)
+	keptTransfer, _ := transfers.get(kept)
+
+	// a pending transfer cannot be resumed and is dropped when the friend goes
+	// offline
+	pending := addTestTransfer(t, 1, 1, 100)
+	pendingTransfer, _ := transfers.get(pending)
+	pendingTransfer.state = TRANSFER_PENDING
+	transfers.set(pending, pendingTransfer)
+
+	deletedTransfer, _ := transfers.get(deleted)
+	dropFriendTransfers(testFriends[0], true)
+
+	if _, ok := transfers.get(deleted); ok {
+		t.Error("transfer of the deleted friend is still active")
+	}
+	if _, err := os.Stat(deletedTransfer.fileHandle.Name()); !os.IsNotExist(err) {
+		t.Error("incomplete file of the deleted friend has not been removed")
+	}
+	if _, ok := transfers.get(kept); !ok {
+		t.Error("transfer of another friend has been dropped")
+	}
+
+	// the running transfer of friend 1 is not resumable (no file ID), so both
+	// transfers are dropped
+	dropFriendTransfers(testFriends[1], false)
+
+	if n := len(transfers.snapshot()); n != 0 {
+		t.Errorf("%d transfers left, want 0", n)
+	}
+	for _, transfer := range []FileTransfer{keptTransfer, pendingTransfer} {
+		if _, err := os.Stat(transfer.fileHandle.Name()); !os.IsNotExist(err) {
+			t.Errorf("incomplete file %s has not been removed", transfer.fileHandle.Name())
+		}
+	}
+}
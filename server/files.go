@@ -0,0 +1,449 @@
+package main
+
+import (
+	"./persistence"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/codedust/go-tox"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Received files and files uploaded for sending are stored in cfg.DownloadDir
+// under a random name chosen by the server. The name given by the sender is
+// only stored in the database and used (sanitized) in the Content-Disposition
+// header, so it can neither escape the download directory nor end up in the
+// web root.
+//
+// The stored files and their thumbnails may take up cfg.DownloadQuota bytes.
+// Incoming files count with their full size as soon as they are accepted, so
+// a transfer that has been accepted can always be completed. Offers that have
+// not been answered yet do not count, so a friend cannot use up the quota by
+// sending offers nobody accepts. Files that would exceed the quota or
+// cfg.MaxFileSize are rejected automatically.
+
+const FILE_NAME_MAX_LENGTH int = 255
+
+var (
+	ErrFileTooLarge  = errors.New("The file is larger than max_file_size")
+	ErrQuotaExceeded = errors.New("The file does not fit into the download quota")
+)
+
+// contentTypes are the types stored files may be served with. All other
+// files are served as application/octet-stream. Scriptable types (HTML, SVG,
+// ...) must never be added here.
+var contentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".txt":  "text/plain; charset=utf-8",
+}
+
+// sanitizeFilename returns a file name without directories, control and format
+// characters (e.g. bidirectional overrides that disguise the extension) that is
+// safe to show and to offer for download
+// name  the file name given by the sender
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == '/' || r == '"' || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	for len(name) > FILE_NAME_MAX_LENGTH {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	if len(name) == 0 || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// fileContentType returns the Content-Type a file is served with
+// name  the (sanitized) file name
+func fileContentType(name string) string {
+	if contentType, ok := contentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// createStoredFile creates a file with a random name in the download directory
+func createStoredFile() (*os.File, error) {
+	storedName, err := randomToken(24)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(filepath.Join(cfg.DownloadDir, storedName), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// createDownloadFile creates a file with a random name in the download
+// directory and stores its metadata
+// publicKey  the public key of the friend sending the file
+// fileName   the file name given by the sender
+// size       the size of the file
+func createDownloadFile(publicKey []byte, fileName string, size uint64) (*os.File, int64, error) {
+	file, err := createStoredFile()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id, err := storage.StoreFile(hex.EncodeToString(publicKey), true, sanitizeFilename(fileName), filepath.Base(file.Name()), size)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+
+	return file, id, nil
+}
+
+// removeIncompleteFile closes and deletes the file of a transfer that has been
+// cancelled. Our own avatar is only closed.
+// transfer  the file transfer
+func removeIncompleteFile(transfer FileTransfer) {
+	if transfer.fileHandle == nil {
+		// empty avatar transfer
+		return
+	}
+
+	transfer.fileHandle.Close()
+	if transfer.outgoing && transfer.fileKind == gotox.TOX_FILE_KIND_AVATAR {
+		return
+	}
+
+	os.Remove(transfer.fileHandle.Name())
+	if transfer.fileID != 0 {
+		storage.DeleteFile(transfer.fileID)
+	}
+}
+
+// removeStoredFile deletes a file from the download directory. The metadata
+// of complete files is kept for the chat history.
+// f  the file
+func removeStoredFile(f persistence.File) {
+	if err := os.Remove(filepath.Join(cfg.DownloadDir, filepath.Base(f.StoredName))); err != nil && !os.IsNotExist(err) {
+		log.Println("[removeStoredFile] Removing file failed:", err)
+		return
+	}
+
+	if f.Complete {
+		storage.SetFileRemoved(f.ID)
+	} else {
+		storage.DeleteFile(f.ID)
+	}
+
+	// a thumbnail may have been stored since f has been read, but none can
+	// be stored anymore (see storeThumbnail)
+	removeThumbnail(f.ID)
+}
+
+// deleteStoredFile cancels the transfer of a file and deletes it from the
+// download directory. Must only be called from the main loop.
+// t   the Tox instance
+// id  the id of the file
+func deleteStoredFile(t *gotox.Tox, id int64) error {
+	f, err := storage.GetFile(id)
+	if err != nil {
+		return err
+	}
+	if len(f.StoredName) == 0 {
+		return persistence.FileNotFound
+	}
+
+	for key, transfer := range transfers.snapshot() {
+		if transfer.fileID == id {
+			// removes the incomplete file
+			return cancelTransfer(t, key)
+		}
+	}
+
+	removeStoredFile(f)
+	log.Println("[deleteStoredFile] Deleted file", id)
+	return nil
+}
+
+// fileUsage returns the number and the size of the stored files of each
+// friend, largest first. Incoming files that have not been accepted yet are
+// not counted.
+func fileUsage() []persistence.FileUsage {
+	pending := make(map[string]persistence.FileUsage)
+	for key, transfer := range transfers.snapshot() {
+		if !transfer.outgoing && transfer.fileKind == gotox.TOX_FILE_KIND_DATA && transfer.state == TRANSFER_PENDING {
+			p := pending[key.publicKey]
+			p.Files++
+			p.Size += transfer.fileSize
+			pending[key.publicKey] = p
+		}
+	}
+
+	usage := []persistence.FileUsage{}
+	for _, u := range storage.GetFileUsage() {
+		p := pending[u.PublicKey]
+		u.Files -= p.Files
+		u.Size -= p.Size
+		if u.Files > 0 {
+			usage = append(usage, u)
+		}
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Size > usage[j].Size
+	})
+	return usage
+}
+
+// downloadUsage returns the number of bytes taken up by the stored files
+func downloadUsage() uint64 {
+	var used uint64
+	for _, u := range fileUsage() {
+		used += u.Size
+	}
+	return used
+}
+
+// checkDownloadQuota returns ErrFileTooLarge or ErrQuotaExceeded if a
+// received file may not be stored. It is checked when a file is offered and
+// again when it is accepted. Must only be called from the main loop.
+// size  the size of the file
+func checkDownloadQuota(size uint64) error {
+	if cfg.MaxFileSize != 0 && size > uint64(cfg.MaxFileSize) {
+		return ErrFileTooLarge
+	}
+	if cfg.DownloadQuota != 0 && downloadUsage()+size > uint64(cfg.DownloadQuota) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// cleanupDownloads removes the files older than cfg.DownloadMaxAge and the
+// incomplete files that are neither being transferred nor can be resumed
+// (left over after a crash). Must only be called from the main loop.
+func cleanupDownloads() {
+	var before int64
+	if cfg.DownloadMaxAge.Duration != 0 {
+		before = time.Now().Add(-cfg.DownloadMaxAge.Duration).Unix() * 1000
+	}
+
+	active := make(map[int64]bool)
+	for _, transfer := range transfers.snapshot() {
+		active[transfer.fileID] = true
+	}
+
+	removed := 0
+	for _, f := range storage.GetStaleFiles(before) {
+		if !active[f.ID] {
+			removeStoredFile(f)
+			removed++
+		}
+	}
+
+	if removed != 0 {
+		log.Println("[cleanupDownloads] Removed", removed, "files")
+		broadcastToClients(createSimpleJSONEvent("friendlist_update"))
+	}
+}
+
+// uploadedFile returns the body and the name of an uploaded file. The file is
+// either the part "file" of a multipart/form-data body or the raw request body
+// (with the name given in the query).
+// r  the request
+func uploadedFile(r *http.Request) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, r.URL.Query().Get("name"), nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() == "file" {
+			return part, part.FileName(), nil
+		}
+	}
+}
+
+// handleFileUpload stages a file uploaded in the web interface in the download
+// directory and offers it to a friend (given as ?friend=<number>)
+// w  the response
+// r  the request
+func handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rejectWithStatusJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "Files can only be uploaded with POST.")
+		return
+	}
+
+	friend, err := strconv.ParseUint(r.URL.Query().Get("friend"), 10, 32)
+	if err != nil {
+		rejectWithErrorJSON(w, "invalid_friend", "The friend is missing or invalid.")
+		return
+	}
+	friendnumber := uint32(friend)
+
+	token := requestAPIToken(r)
+	var publicKey []byte
+	var limit int64
+	err = toxDo(func(t *gotox.Tox) (err error) {
+		publicKey, err = t.FriendGetPublickey(friendnumber)
+		if err == nil && token != nil && !token.canMessage(hex.EncodeToString(publicKey)) {
+			return ErrInsufficientScope
+		}
+
+		// the staged file counts towards the download quota
+		limit = cfg.MaxUploadSize
+		if cfg.DownloadQuota != 0 {
+			if free := cfg.DownloadQuota - int64(downloadUsage()); free < limit {
+				limit = free
+			}
+		}
+		return err
+	})
+	if err == ErrInsufficientScope {
+		rejectWithStatusJSON(w, http.StatusForbidden, "insufficient_scope", "The API token does not allow sending files to this friend.")
+		return
+	} else if err != nil {
+		rejectWithFriendErrorJSON(w, err)
+		return
+	}
+	if limit <= 0 {
+		rejectWithErrorJSON(w, "quota_exceeded", "The download quota is used up. Delete some files first.")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	body, name, err := uploadedFile(r)
+	if err != nil {
+		rejectWithErrorJSON(w, "invalid_upload", "The request does not contain a file.")
+		return
+	}
+	name = sanitizeFilename(name)
+
+	file, err := createStoredFile()
+	if err != nil {
+		log.Println("[handleFileUpload] Creating file failed:", err)
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	size, err := io.Copy(file, body)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		rejectWithErrorJSON(w, "upload_failed", "The upload failed or the file is too large.")
+		return
+	}
+
+	id, err := storage.StoreFile(hex.EncodeToString(publicKey), false, name, filepath.Base(file.Name()), uint64(size))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	transfer := FileTransfer{friendNumber: friendnumber, fileHandle: file, fileSize: uint64(size), fileKind: gotox.TOX_FILE_KIND_DATA, fileID: id, fileName: name, outgoing: true}
+	var filenumber uint32
+	err = toxDo(func(t *gotox.Tox) (err error) {
+		filenumber, err = sendFile(t, transfer)
+		return err
+	})
+	if err != nil {
+		removeIncompleteFile(transfer)
+		rejectWithErrorJSON(w, "send_failed", "The file could not be sent. Is your friend online?")
+		return
+	}
+	log.Println("[handleFileUpload] Sending file", id, "to friend", friendnumber)
+
+	type sentFile struct {
+		ID   int64  `json:"id"`
+		File uint32 `json:"file"`
+	}
+
+	fJSON, _ := json.Marshal(sentFile{ID: id, File: filenumber})
+	w.Write(fJSON)
+
+	// broadcast status to all connected clients
+	broadcastToClients(createSimpleJSONEvent("transfers_update"))
+	broadcastToClients(createSimpleJSONEvent("friendlist_update"))
+}
+
+// handleFileDownload serves a completely transferred file as an attachment
+// w   the response
+// r   the request
+// id  the id of the file (as in /api/files/{id})
+func handleFileDownload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rejectWithStatusJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "Files can only be downloaded with GET.")
+		return
+	}
+
+	fileID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		rejectWithStatusJSON(w, http.StatusNotFound, "file_not_found", "The file does not exist.")
+		return
+	}
+
+	f, err := storage.GetFile(fileID)
+	if err == persistence.FileNotFound || (err == nil && (!f.Complete || len(f.StoredName) == 0)) {
+		rejectWithStatusJSON(w, http.StatusNotFound, "file_not_found", "The file does not exist.")
+		return
+	} else if err != nil {
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(cfg.DownloadDir, filepath.Base(f.StoredName)))
+	if err != nil {
+		log.Println("[handleFileDownload] Opening file failed:", err)
+		rejectWithStatusJSON(w, http.StatusNotFound, "file_not_found", "The file does not exist.")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": f.FileName})
+	if len(disposition) == 0 {
+		// FormatMediaType fails for non-ASCII names, use RFC 5987 encoding
+		disposition = "attachment; filename*=UTF-8''" + url.PathEscape(f.FileName)
+	}
+
+	w.Header().Set("Content-Type", fileContentType(f.FileName))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -1,26 +1,24 @@
 package main
 
 import (
+	"./persistence"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/codedust/go-httpserve"
 	"github.com/codedust/go-tox"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 
-	if tox == nil {
-		log.Print("[handleAPI] ERROR: tox is nil.")
-		rejectWithDefaultErrorJSON(w)
-		return
-	}
-
 	if storage == nil {
 		log.Print("[handleAPI] ERROR: storage is nil.")
 		rejectWithDefaultErrorJSON(w)
@@ -70,27 +68,187 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				StatusMessage string `json:"status_msg"`
 				ToxID         string `json:"tox_id"`
 				Status        string `json:"status"`
+				HasAvatar     bool   `json:"has_avatar"`
 			}
 
-			username, _ := tox.SelfGetName()
-			statusMessage, _ := tox.SelfGetStatusMessage()
-			toxid, _ := tox.SelfGetAddress()
-			status, _ := tox.SelfGetStatus()
+			var username string
+			var statusMessage, toxid []byte
+			var status gotox.ToxUserStatus
+			toxDo(func(t *gotox.Tox) error {
+				username, _ = t.SelfGetName()
+				statusMessage, _ = t.SelfGetStatusMessage()
+				toxid, _ = t.SelfGetAddress()
+				status, _ = t.SelfGetStatus()
+				return nil
+			})
+
 			p := profile{
 				Username:      username,
 				StatusMessage: string(statusMessage),
 				ToxID:         strings.ToUpper(hex.EncodeToString(toxid)),
 				Status:        getUserStatusAsString(status),
 			}
+			p.HasAvatar, _ = fileExists(selfAvatarPath())
 
 			pJSON, _ := json.Marshal(p)
 			fmt.Fprintf(w, string(pJSON))
 
+		case "/get/network":
+			type network struct {
+				Connection         string `json:"connection"`
+				Online             bool   `json:"online"`
+				LastChange         int64  `json:"last_change"`
+				SecondsSinceChange int64  `json:"seconds_since_change"`
+				UDPPort            uint16 `json:"udp_port"`
+				TCPPort            uint16 `json:"tcp_port"`
+				DHTPublicKey       string `json:"dht_public_key"`
+			}
+
+			status, since := getSelfConnectionStatus()
+			var udpPort, tcpPort uint16
+			var dhtID []byte
+			toxDo(func(t *gotox.Tox) error {
+				udpPort, _ = t.SelfGetUdpPort()
+				tcpPort, _ = t.SelfGetTcpPort()
+				dhtID, _ = t.SelfGetDhtId()
+				return nil
+			})
+
+			n := network{
+				Connection:         getConnectionStatusAsString(status),
+				Online:             status != gotox.TOX_CONNECTION_NONE,
+				LastChange:         since.Unix() * 1000,
+				SecondsSinceChange: int64(time.Since(since).Seconds()),
+				UDPPort:            udpPort,
+				TCPPort:            tcpPort,
+				DHTPublicKey:       strings.ToUpper(hex.EncodeToString(dhtID)),
+			}
+
+			nJSON, _ := json.Marshal(n)
+			w.Write(nJSON)
+
+		case "/get/login_blocks":
+			blocksJSON, _ := json.Marshal(logins.list())
+			w.Write(blocksJSON)
+
+		case "/get/api_tokens":
+			type token struct {
+				ID          int64    `json:"id"`
+				Name        string   `json:"name"`
+				Scopes      []string `json:"scopes"`
+				Friends     []string `json:"friends"`
+				Created     int64    `json:"created"`
+				LastUsed    int64    `json:"last_used"`
+				LastAddress string   `json:"last_address"`
+			}
+
+			tokens := []token{}
+			for _, t := range storage.GetAPITokens() {
+				tokens = append(tokens, token{
+					ID:          t.ID,
+					Name:        t.Name,
+					Scopes:      splitList(t.Scopes),
+					Friends:     splitList(t.Friends),
+					Created:     t.Created,
+					LastUsed:    t.LastUsed,
+					LastAddress: t.LastAddress,
+				})
+			}
+
+			tokensJSON, _ := json.Marshal(tokens)
+			w.Write(tokensJSON)
+
+		case "/get/transfers":
+			var list []transferInfo
+			toxDo(func(t *gotox.Tox) error {
+				list = listTransfers()
+				return nil
+			})
+
+			tJSON, _ := json.Marshal(list)
+			w.Write(tJSON)
+
+		case "/get/storage":
+			type friendUsage struct {
+				PublicKey string `json:"publicKey"`
+				Name      string `json:"name"`
+				Files     int    `json:"files"`
+				Size      uint64 `json:"size"`
+			}
+
+			type storageUsage struct {
+				Used        uint64        `json:"used"`
+				Quota       int64         `json:"quota"`
+				MaxFileSize int64         `json:"max_file_size"`
+				MaxAge      Duration      `json:"max_age"`
+				Friends     []friendUsage `json:"friends"`
+			}
+
+			usage := storageUsage{Friends: []friendUsage{}}
+			for _, u := range fileUsage() {
+				usage.Used += u.Size
+				usage.Friends = append(usage.Friends, friendUsage{PublicKey: u.PublicKey, Files: u.Files, Size: u.Size})
+			}
+
+			toxDo(func(t *gotox.Tox) error {
+				// the limits are changed by reloadConfig in the main loop
+				usage.Quota, usage.MaxFileSize, usage.MaxAge = cfg.DownloadQuota, cfg.MaxFileSize, cfg.DownloadMaxAge
+
+				for i := range usage.Friends {
+					// the name of deleted friends is unknown
+					if publicKey, err := hex.DecodeString(usage.Friends[i].PublicKey); err == nil {
+						if friendnumber, err := t.FriendByPublicKey(publicKey); err == nil {
+							usage.Friends[i].Name, _ = t.FriendGetName(friendnumber)
+						}
+					}
+				}
+				return nil
+			})
+
+			uJSON, _ := json.Marshal(usage)
+			w.Write(uJSON)
+
+		case "/get/stats":
+			type stats struct {
+				IterationInterval int64  `json:"iteration_interval_ms"`
+				Iterations        uint64 `json:"iterations"`
+				LowPower          bool   `json:"low_power"`
+				Clients           int    `json:"clients"`
+			}
+
+			iterationStats.Lock()
+			st := stats{
+				IterationInterval: int64(iterationStats.interval / time.Millisecond),
+				Iterations:        iterationStats.iterations,
+				LowPower:          iterationStats.lowPower,
+				Clients:           len(getActiveConnections()),
+			}
+			iterationStats.Unlock()
+
+			stJSON, _ := json.Marshal(st)
+			w.Write(stJSON)
+
 		case "/get/settings":
+			type toxSettings struct {
+				IPv6Enabled bool   `json:"ipv6_enabled"`
+				UDPEnabled  bool   `json:"udp_enabled"`
+				ProxyType   string `json:"proxy_type"`
+				ProxyHost   string `json:"proxy_host"`
+				ProxyPort   int    `json:"proxy_port"`
+				StartPort   int    `json:"start_port"`
+				EndPort     int    `json:"end_port"`
+			}
+
 			type settings struct {
-				AuthUser             string `json:"auth_user"`
-				AwayOnDisconnect     bool   `json:"away_on_disconnect"`
-				NotificationsEnabled bool   `json:"notifications_enabled"`
+				AuthUser             string           `json:"auth_user"`
+				AwayOnDisconnect     bool             `json:"away_on_disconnect"`
+				NotificationsEnabled bool             `json:"notifications_enabled"`
+				TOTPEnabled          bool             `json:"totp_enabled"`
+				RecoveryCodesLeft    int              `json:"recovery_codes_left"`
+				ListenAddresses      []string         `json:"listen_addresses"`
+				LocalhostOnly        bool             `json:"localhost_only"`
+				AutoAccept           []autoAcceptRule `json:"auto_accept"`
+				Tox                  toxSettings      `json:"tox"`
 			}
 
 			username, _ := storage.GetKeyValue("settings_auth_user")
@@ -99,14 +257,30 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			awayOnDisconnectString, _ := storage.GetKeyValue("settings_away_on_disconnect")
 			awayOnDisconnect, _ := strconv.ParseBool(awayOnDisconnectString)
 
+			toxConfig := currentToxConfig()
+
 			s := settings{
 				AuthUser:             username,
 				AwayOnDisconnect:     awayOnDisconnect,
 				NotificationsEnabled: notificationsEnabled,
+				TOTPEnabled:          isTOTPEnabled(),
+				RecoveryCodesLeft:    len(recoveryCodeHashes()),
+				ListenAddresses:      cfg.ListenAddresses,
+				LocalhostOnly:        clientFilter.isLocalhostOnly(),
+				AutoAccept:           getAutoAcceptRules(),
+				Tox: toxSettings{
+					IPv6Enabled: toxConfig.IPv6Enabled,
+					UDPEnabled:  toxConfig.UDPEnabled,
+					ProxyType:   strings.ToUpper(toxConfig.ProxyType),
+					ProxyHost:   toxConfig.ProxyHost,
+					ProxyPort:   toxConfig.ProxyPort,
+					StartPort:   toxConfig.StartPort,
+					EndPort:     toxConfig.EndPort,
+				},
 			}
 
 			sJSON, _ := json.Marshal(s)
-			fmt.Fprintf(w, string(sJSON))
+			w.Write(sJSON)
 
 		default:
 			// unknown GET request
@@ -116,9 +290,18 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 	// POST REQUESTS
 	case strings.HasPrefix(request, "/post/"):
-		data := make([]byte, r.ContentLength)
-		bytesRead, err := r.Body.Read(data)
-		if err != nil && bytesRead == 0 {
+		if r.ContentLength > cfg.MaxRequestSize {
+			rejectWithErrorJSON(w, "request_too_large", "The request is too large.")
+			return
+		}
+
+		// the body may be chunked, so its length is not known in advance
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxRequestSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rejectWithErrorJSON(w, "request_too_large", "The request is too large.")
+			return
+		} else if err != nil {
 			rejectWithDefaultErrorJSON(w)
 			return
 		}
@@ -137,13 +320,29 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			_, err = tox.FriendSendMessage(incomingData.Friend, gotox.TOX_MESSAGE_TYPE_NORMAL, incomingData.Message)
-			if err != nil {
+			token := requestAPIToken(r)
+			var publicKey []byte
+			err = toxDo(func(t *gotox.Tox) error {
+				if token != nil {
+					publicKey, _ = t.FriendGetPublickey(incomingData.Friend)
+					if !token.canMessage(hex.EncodeToString(publicKey)) {
+						return ErrInsufficientScope
+					}
+				}
+				if _, err := t.FriendSendMessage(incomingData.Friend, gotox.TOX_MESSAGE_TYPE_NORMAL, incomingData.Message); err != nil {
+					return err
+				}
+				publicKey, _ = t.FriendGetPublickey(incomingData.Friend)
+				return nil
+			})
+			if err == ErrInsufficientScope {
+				rejectWithStatusJSON(w, http.StatusForbidden, "insufficient_scope", "The API token does not allow sending messages to this friend.")
+				return
+			} else if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
 
-			publicKey, _ := tox.FriendGetPublickey(incomingData.Friend)
 			storage.StoreMessage(hex.EncodeToString(publicKey), false, false, incomingData.Message)
 			storage.SetLastMessageRead(hex.EncodeToString(publicKey))
 
@@ -162,7 +361,11 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			publicKey, _ := tox.FriendGetPublickey(incomingData.Friend)
+			var publicKey []byte
+			toxDo(func(t *gotox.Tox) (err error) {
+				publicKey, err = t.FriendGetPublickey(incomingData.Friend)
+				return err
+			})
 			storage.SetLastMessageRead(hex.EncodeToString(publicKey))
 
 			// broadcast status to all connected clients
@@ -180,10 +383,14 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err = tox.SelfSetName(incomingData.Username); err != nil {
+			err = toxDo(func(t *gotox.Tox) error {
+				return t.SelfSetName(incomingData.Username)
+			})
+			if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
+			requestSave()
 
 		case "/post/status":
 			type profile struct {
@@ -197,7 +404,10 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err = tox.SelfSetStatus(getUserStatusFromString(incomingData.Status)); err != nil {
+			err = toxDo(func(t *gotox.Tox) error {
+				return t.SelfSetStatus(getUserStatusFromString(incomingData.Status))
+			})
+			if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
@@ -214,10 +424,14 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err = tox.SelfSetStatusMessage(incomingData.StatusMessage); err != nil {
+			err = toxDo(func(t *gotox.Tox) error {
+				return t.SelfSetStatusMessage(incomingData.StatusMessage)
+			})
+			if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
+			requestSave()
 
 		case "/post/friend_request":
 			type friendRequest struct {
@@ -243,11 +457,16 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			friendID, err := tox.FriendAdd(friendAddressBytes, incomingData.Message)
+			var friendID uint32
+			err = toxDo(func(t *gotox.Tox) (err error) {
+				friendID, err = t.FriendAdd(friendAddressBytes, incomingData.Message)
+				return err
+			})
 			if err != nil {
 				rejectWithFriendErrorJSON(w, err)
 				return
 			}
+			requestSave()
 			fmt.Fprintf(w, string(friendID))
 
 		case "/post/friend_request_is_ignored":
@@ -283,11 +502,15 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			_, err = tox.FriendAddNorequest(publicKeyBytes)
+			err = toxDo(func(t *gotox.Tox) error {
+				_, err := t.FriendAddNorequest(publicKeyBytes)
+				return err
+			})
 			if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
+			requestSave()
 
 			storage.DeleteFriendRequest(incomingData.PublicKey)
 
@@ -306,11 +529,51 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			err = tox.FriendDelete(incomingData.Number)
+			err = toxDo(func(t *gotox.Tox) error {
+				publicKey, err := t.FriendGetPublickey(incomingData.Number)
+				if err != nil {
+					return err
+				}
+				if err = t.FriendDelete(incomingData.Number); err != nil {
+					return err
+				}
+
+				// the friend number may be reused for the next friend
+				dropFriendTransfers(publicKey, true)
+				os.Remove(friendAvatarPath(hex.EncodeToString(publicKey)))
+				return nil
+			})
 			if err != nil {
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
+			requestSave()
+
+		case "/post/delete_file":
+			type file struct {
+				ID int64 `json:"id"`
+			}
+
+			var incomingData file
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			err = toxDo(func(t *gotox.Tox) error {
+				return deleteStoredFile(t, incomingData.ID)
+			})
+			if err == persistence.FileNotFound {
+				rejectWithErrorJSON(w, "file_not_found", "The file does not exist.")
+				return
+			} else if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			// broadcast status to all connected clients
+			broadcastToClients(createSimpleJSONEvent("friendlist_update"))
 
 		case "/post/settings_auth_user":
 			type user struct {
@@ -328,8 +591,6 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			httpserve.ChangeAuthOptionsUser(authOptions, incomingData.Username)
-
 		case "/post/settings_auth_pass":
 			type user struct {
 				Password string `json:"password"`
@@ -341,22 +602,273 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			salt, err := httpserve.RandomString(32)
+			if err = storePassword(incomingData.Password); err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			// log out everywhere else
+			sessions.destroyOthers(r)
+
+		case "/post/totp_enroll":
+			type enrollment struct {
+				Secret string `json:"secret"`
+				URI    string `json:"uri"`
+			}
+
+			if isTOTPEnabled() {
+				rejectWithErrorJSON(w, "totp_enabled", "Two-factor authentication is already enabled.")
+				return
+			}
+
+			secret, uri, err := beginTOTPEnrollment()
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			eJSON, _ := json.Marshal(enrollment{Secret: secret, URI: uri})
+			w.Write(eJSON)
+
+		case "/post/totp_confirm", "/post/totp_disable", "/post/totp_recovery_codes":
+			type totpCode struct {
+				Code string `json:"code"`
+			}
+			type recoveryCodes struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			}
+
+			var incomingData totpCode
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			var codes []string
+			if request == "/post/totp_confirm" {
+				var ok bool
+				if codes, ok = confirmTOTPEnrollment(incomingData.Code); !ok {
+					rejectWithErrorJSON(w, "invalid_code", "The code you entered is not valid.")
+					return
+				}
+			} else {
+				if !checkSecondFactor(incomingData.Code) {
+					rejectWithErrorJSON(w, "invalid_code", "The code you entered is not valid.")
+					return
+				}
+
+				if request == "/post/totp_disable" {
+					disableTOTP()
+				} else if codes, err = generateRecoveryCodes(); err != nil {
+					rejectWithDefaultErrorJSON(w)
+					return
+				}
+			}
+
+			if codes != nil {
+				cJSON, _ := json.Marshal(recoveryCodes{RecoveryCodes: codes})
+				w.Write(cJSON)
+			}
+
+			// broadcast status to all connected clients
+			broadcastToClients(createSimpleJSONEvent("settings_update"))
+
+		case "/post/login_blocks_clear":
+			type loginBlock struct {
+				Type string `json:"type"`
+				Key  string `json:"key"`
+			}
+
+			var incomingData loginBlock
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			logins.clear(incomingData.Type, incomingData.Key)
+			log.Println("[handleAPI] Login blocks cleared:", incomingData.Type, incomingData.Key)
+
+		case "/post/api_token_create":
+			type tokenRequest struct {
+				Name    string   `json:"name"`
+				Scopes  []string `json:"scopes"`
+				Friends []string `json:"friends"`
+			}
+			type newToken struct {
+				ID    int64  `json:"id"`
+				Token string `json:"token"`
+			}
+
+			var incomingData tokenRequest
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			token, id, err := createAPIToken(strings.TrimSpace(incomingData.Name), incomingData.Scopes, incomingData.Friends)
+			if err != nil {
+				rejectWithErrorJSON(w, "invalid_token", err.Error())
+				return
+			}
+			log.Println("[handleAPI] API token created:", incomingData.Name)
+
+			tJSON, _ := json.Marshal(newToken{ID: id, Token: token})
+			w.Write(tJSON)
+
+		case "/post/api_token_revoke":
+			type tokenID struct {
+				ID int64 `json:"id"`
+			}
+
+			var incomingData tokenID
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			if err = storage.DeleteAPIToken(incomingData.ID); err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+			log.Println("[handleAPI] API token revoked:", incomingData.ID)
+
+		case "/post/file_accept", "/post/file_reject", "/post/transfer_pause", "/post/transfer_resume", "/post/transfer_cancel":
+			type fileRequest struct {
+				Friend uint32 `json:"friend"`
+				File   uint32 `json:"file"`
+				Name   string `json:"name"`
+			}
+
+			var incomingData fileRequest
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			err = toxDo(func(t *gotox.Tox) error {
+				key, err := friendTransferKey(t, incomingData.Friend, incomingData.File)
+				if err != nil {
+					return ErrTransferNotFound
+				}
+
+				switch request {
+				case "/post/file_accept":
+					return acceptTransfer(t, key, incomingData.Name)
+				case "/post/file_reject":
+					return rejectTransfer(t, key)
+				case "/post/transfer_pause":
+					return pauseTransfer(t, key)
+				case "/post/transfer_resume":
+					return resumeTransfer(t, key)
+				default:
+					return cancelTransfer(t, key)
+				}
+			})
+			if err == ErrTransferNotFound {
+				rejectWithErrorJSON(w, "transfer_not_found", "The file transfer does not exist or has already been answered.")
+				return
+			} else if err == ErrInvalidTransferState {
+				rejectWithErrorJSON(w, "invalid_transfer_state", err.Error()+".")
+				return
+			} else if err == ErrQuotaExceeded || err == ErrFileTooLarge {
+				rejectWithErrorJSON(w, "quota_exceeded", err.Error()+". Delete some files first.")
+				return
+			} else if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			// the file may have been renamed (other changes are sent as
+			// transfer_progress events)
+			if request == "/post/file_accept" {
+				broadcastToClients(createSimpleJSONEvent("friendlist_update"))
+			}
+
+		case "/post/auto_accept":
+			type autoAccept struct {
+				Rules []autoAcceptRule `json:"rules"`
+			}
+
+			var incomingData autoAccept
+			err = json.Unmarshal(data, &incomingData)
+			if err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+			if incomingData.Rules == nil {
+				incomingData.Rules = []autoAcceptRule{}
+			}
+			if err = storeAutoAcceptRules(incomingData.Rules); err != nil {
+				rejectWithErrorJSON(w, "invalid_rule", err.Error())
+				return
+			}
+
+			// broadcast status to all connected clients
+			broadcastToClients(createSimpleJSONEvent("settings_update"))
+
+		case "/post/logout":
+			if err = sessions.destroy(w, r); err != nil {
+				rejectWithDefaultErrorJSON(w)
+				return
+			}
+
+		case "/post/settings_network":
+			type toxSettings struct {
+				IPv6Enabled bool   `json:"ipv6_enabled"`
+				UDPEnabled  bool   `json:"udp_enabled"`
+				ProxyType   string `json:"proxy_type"`
+				ProxyHost   string `json:"proxy_host"`
+				ProxyPort   int    `json:"proxy_port"`
+				StartPort   int    `json:"start_port"`
+				EndPort     int    `json:"end_port"`
+			}
+
+			var incomingData toxSettings
+			err = json.Unmarshal(data, &incomingData)
 			if err != nil {
-				panic("could not generate salt")
+				rejectWithDefaultErrorJSON(w)
+				return
 			}
 
-			pass := httpserve.Sha512Sum(incomingData.Password + salt)
+			oldConfig := currentToxConfig()
+			toxConfig := oldConfig
+			toxConfig.IPv6Enabled = incomingData.IPv6Enabled
+			toxConfig.UDPEnabled = incomingData.UDPEnabled
+			toxConfig.ProxyType = strings.ToUpper(incomingData.ProxyType)
+			toxConfig.ProxyHost = incomingData.ProxyHost
+			toxConfig.ProxyPort = incomingData.ProxyPort
+			toxConfig.StartPort = incomingData.StartPort
+			toxConfig.EndPort = incomingData.EndPort
 
-			err = storage.StoreKeyValue("settings_auth_pass", pass)
-			err2 := storage.StoreKeyValue("settings_auth_salt", salt)
+			if errs := toxConfig.validate(); len(errs) != 0 {
+				rejectWithErrorJSON(w, "invalid_settings", strings.Join(errs, ", "))
+				return
+			}
 
-			if err != nil || err2 != nil {
+			// store the settings first, so the running instance never uses
+			// settings that are lost on the next start
+			if err = storeToxSettings(&toxConfig); err != nil {
+				storeToxSettings(&oldConfig)
 				rejectWithDefaultErrorJSON(w)
 				return
 			}
 
-			httpserve.ChangeAuthOptionsPass(authOptions, pass, salt)
+			req := toxRestartRequest{config: toxConfig, result: make(chan error)}
+			toxRestartRequests <- req
+			if err = <-req.result; err != nil {
+				storeToxSettings(&oldConfig)
+				rejectWithErrorJSON(w, "restart_failed", "The new network settings could not be applied.")
+				return
+			}
+
+			// broadcast status to all connected clients
+			broadcastToClients(createSimpleJSONEvent("settings_update"))
 
 		case "/post/keyValue":
 			type keyValue struct {
@@ -393,6 +905,22 @@ var handleAPI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+	// FILE UPLOADS AND DOWNLOADS
+	case request == "/files":
+		handleFileUpload(w, r)
+
+	case request == "/avatar":
+		handleAvatar(w, r)
+
+	case strings.HasPrefix(request, "/avatar/"):
+		handleFriendAvatar(w, r, request[len("/avatar/"):])
+
+	case strings.HasPrefix(request, "/files/") && strings.HasSuffix(request, "/thumbnail"):
+		handleThumbnailDownload(w, r, strings.TrimSuffix(request[len("/files/"):], "/thumbnail"))
+
+	case strings.HasPrefix(request, "/files/"):
+		handleFileDownload(w, r, request[len("/files/"):])
+
 	default:
 		// unknown API request
 		rejectWithDefaultErrorJSON(w)
@@ -5,15 +5,40 @@ import (
 	"github.com/codedust/go-tox"
 	"golang.org/x/net/websocket"
 	"strconv"
+	"sync"
 )
 
 var activeConnections = make(map[*websocket.Conn]bool)
 
+// activeConnectionsMtx protects activeConnections
+var activeConnectionsMtx sync.Mutex
+
+// getActiveConnections returns a copy of the list of active connections
+func getActiveConnections() []*websocket.Conn {
+	activeConnectionsMtx.Lock()
+	defer activeConnectionsMtx.Unlock()
+
+	conns := make([]*websocket.Conn, 0, len(activeConnections))
+	for conn := range activeConnections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// closeAllConnections closes all WebSocket connections (sending a close frame)
+func closeAllConnections() {
+	for _, conn := range getActiveConnections() {
+		if err := conn.Close(); err != nil {
+			fmt.Println("[handleWS] Websocket could not be closed", err.Error())
+		}
+	}
+}
+
 func broadcastToClients(msg string) {
 	go func() {
-		for conn, _ := range activeConnections {
+		for _, conn := range getActiveConnections() {
 			if err := websocket.Message.Send(conn, msg); err != nil {
-				fmt.Println("[handleWS] Could not send message to ", conn.RemoteAddr, err.Error())
+				fmt.Println("[handleWS] Could not send message to ", conn.RemoteAddr(), err.Error())
 			}
 		}
 	}()
@@ -30,15 +55,20 @@ var handleWS = websocket.Handler(func(conn *websocket.Conn) {
 		}
 	}()
 
+	activeConnectionsMtx.Lock()
 	activeConnections[conn] = true
+	numConnections := len(activeConnections)
+	activeConnectionsMtx.Unlock()
 	fmt.Println("[handleWS] Client connected:", conn.Request().RemoteAddr)
-	fmt.Println("[handleWS] Number of clients connected:", len(activeConnections))
+	fmt.Println("[handleWS] Number of clients connected:", numConnections)
 
 	awayOnDisconnectString, _ := storage.GetKeyValue("settings_away_on_disconnect")
 	awayOnDisconnect, _ := strconv.ParseBool(awayOnDisconnectString)
 
-	if awayOnDisconnect && len(activeConnections) == 1 {
-		tox.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
+	if awayOnDisconnect && numConnections == 1 {
+		toxDo(func(t *gotox.Tox) error {
+			return t.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
+		})
 		broadcastToClients(createSimpleJSONEvent("profile_update"))
 	}
 
@@ -46,15 +76,20 @@ var handleWS = websocket.Handler(func(conn *websocket.Conn) {
 		if err = websocket.Message.Receive(conn, &clientMessage); err != nil {
 			// the connection is closed
 			fmt.Println("[handleWS] Read error. Removing client.", err.Error())
+			activeConnectionsMtx.Lock()
 			delete(activeConnections, conn)
-			fmt.Println("[handleWS] Number of clients still connected:", len(activeConnections))
+			numConnections := len(activeConnections)
+			activeConnectionsMtx.Unlock()
+			fmt.Println("[handleWS] Number of clients still connected:", numConnections)
 
-			if len(activeConnections) == 0 {
+			if numConnections == 0 {
 				awayOnDisconnectString, _ := storage.GetKeyValue("settings_away_on_disconnect")
 				awayOnDisconnect, _ := strconv.ParseBool(awayOnDisconnectString)
 
 				if awayOnDisconnect {
-					tox.SelfSetStatus(gotox.TOX_USERSTATUS_AWAY)
+					toxDo(func(t *gotox.Tox) error {
+						return t.SelfSetStatus(gotox.TOX_USERSTATUS_AWAY)
+					})
 				}
 			}
 			return
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"github.com/codedust/go-httpserve"
 	"github.com/codedust/go-tox"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // getUserStatusAsString returns a string representing the given Tox user status
@@ -24,6 +28,22 @@ func getUserStatusAsString(status gotox.ToxUserStatus) string {
 	}
 }
 
+// getConnectionStatusAsString returns a string representing the given Tox
+// connection status
+// status  the Tox connection status to be converted
+func getConnectionStatusAsString(status gotox.ToxConnection) string {
+	switch status {
+	case gotox.TOX_CONNECTION_NONE:
+		return "NONE"
+	case gotox.TOX_CONNECTION_TCP:
+		return "TCP"
+	case gotox.TOX_CONNECTION_UDP:
+		return "UDP"
+	default:
+		return "INVALID"
+	}
+}
+
 // getUserStatusFromString returns the Tox user status represented by the given
 // user status string
 // status  the user status as a string to be converted
@@ -40,11 +60,34 @@ func getUserStatusFromString(status string) gotox.ToxUserStatus {
 	}
 }
 
-// saveData writes the current Tox saveData to a file
+// getProxyTypeFromString returns the Tox proxy type represented by the given
+// string (NONE, HTTP or SOCKS5, case insensitive)
+// proxyType  the proxy type as a string to be converted
+func getProxyTypeFromString(proxyType string) (gotox.ToxProxyType, error) {
+	switch strings.ToUpper(proxyType) {
+	case "NONE":
+		return gotox.TOX_PROXY_TYPE_NONE, nil
+	case "HTTP":
+		return gotox.TOX_PROXY_TYPE_HTTP, nil
+	case "SOCKS5":
+		return gotox.TOX_PROXY_TYPE_SOCKS5, nil
+	default:
+		return gotox.TOX_PROXY_TYPE_NONE, errors.New("Unknown proxy type " + proxyType)
+	}
+}
+
+// saveData atomically writes the current Tox saveData to a file. The data is
+// written to a temporary file in the same directory which is synced and then
+// renamed, so an interrupted write can never replace a good save file. Before
+// the file is replaced, the previous version is kept as savePath.1 and older
+// backups are rotated up to savePath.<backups>.
+// If pk is not nil, the saveData is encrypted in the toxencryptsave format.
 // t         the gotox instance whichs saveData will be stored
-// filepath  the path to the file the saveData will be stored in
-func saveData(t *gotox.Tox, filepath string) error {
-	if len(filepath) == 0 {
+// savePath  the path to the file the saveData will be stored in
+// backups   the number of backups to keep
+// pk        the key used for encryption or nil
+func saveData(t *gotox.Tox, savePath string, backups int, pk *passKey) error {
+	if len(savePath) == 0 {
 		return errors.New("Empty path")
 	}
 
@@ -53,8 +96,79 @@ func saveData(t *gotox.Tox, filepath string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath, data, 0644)
-	return err
+	if bytes.Equal(data, lastSavedata) {
+		// nothing changed since the last save
+		return nil
+	}
+
+	fileData := data
+	if pk != nil {
+		if fileData, err = encryptData(pk, data); err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Dir(savePath)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(savePath)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(fileData); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	rotateBackups(savePath, backups)
+
+	if err = os.Rename(tmp.Name(), savePath); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// make sure the rename itself is persisted
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	lastSavedata = data
+	return nil
+}
+
+// rotateBackups shifts savePath.1 ... savePath.<backups-1> up by one and links
+// the current save file to savePath.1. The current save file itself stays in
+// place until it is atomically replaced by the caller.
+// savePath  the path to the save file
+// backups   the number of backups to keep
+func rotateBackups(savePath string, backups int) {
+	if backups <= 0 {
+		return
+	}
+
+	if exists, _ := fileExists(savePath); !exists {
+		return
+	}
+
+	os.Remove(backupPath(savePath, backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(backupPath(savePath, i), backupPath(savePath, i+1))
+	}
+
+	if err := os.Link(savePath, backupPath(savePath, 1)); err != nil {
+		log.Println("[saveData] Could not create backup of", savePath, err)
+	}
+}
+
+// backupPath returns the path of the n-th backup of a save file
+func backupPath(savePath string, n int) string {
+	return savePath + "." + strconv.Itoa(n)
 }
 
 // loadData reads a file and returns its contents as a byte array
@@ -87,26 +201,19 @@ func fileExists(path string) (bool, error) {
 
 // storeDefaultHTTPAuth generates a random password and stores it into the
 // database (used for initialisation)
-func storeDefaultHTTPAuth() (string, string, string) {
-	salt, err := httpserve.RandomString(32)
-	if err != nil {
-		panic("could not generate salt")
-	}
-
+func storeDefaultHTTPAuth() {
 	plainPass, err := httpserve.RandomString(32)
 	if err != nil {
-		panic("could not generate salt")
+		panic("could not generate password")
 	}
 
 	user := CFG_DEFAULT_AUTH_USER
-	pass := httpserve.Sha512Sum(plainPass + salt)
 
 	log.Println("Info: Username reset to: ", user)
 	log.Println("Info: Password reset to: ", plainPass)
 
 	storage.StoreKeyValue("settings_auth_user", user)
-	storage.StoreKeyValue("settings_auth_pass", pass)
-	storage.StoreKeyValue("settings_auth_salt", salt)
-
-	return user, pass, salt
+	if err = storePassword(plainPass); err != nil {
+		panic("could not store password")
+	}
 }
@@ -6,13 +6,62 @@ import (
 	"github.com/codedust/go-tox"
 )
 
-// getFriendListJSON returns the users Tox friendlist as a JSON string
+// friendState is the state of a friend as known by toxcore
+type friendState struct {
+	number     uint32
+	publicKey  []byte
+	name       string
+	connection gotox.ToxConnection
+	status     gotox.ToxUserStatus
+	statusMsg  []byte
+}
+
+// getFriendStates returns the state of all friends. Must only be called from
+// the main loop (see toxDo).
+// t  the Tox instance
+func getFriendStates(t *gotox.Tox) ([]friendState, error) {
+	friend_ids, err := t.SelfGetFriendlist()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]friendState, len(friend_ids))
+	for i, friend_num := range friend_ids {
+		// TODO: handle errors
+		states[i].number = friend_num
+		states[i].publicKey, _ = t.FriendGetPublickey(friend_num)
+		states[i].name, _ = t.FriendGetName(friend_num)
+		states[i].connection, _ = t.FriendGetConnectionStatus(friend_num)
+		states[i].status, _ = t.FriendGetStatus(friend_num)
+		states[i].statusMsg, _ = t.FriendGetStatusMessage(friend_num)
+	}
+	return states, nil
+}
+
+// getFriendListJSON returns the users Tox friendlist as a JSON string. Only
+// the state of the friends is read in the main loop, the chat history is
+// read from the database afterwards, so the main loop is not blocked.
 func getFriendListJSON() (string, error) {
+	type thumbnailInfo struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}
+
+	type fileInfo struct {
+		ID        int64          `json:"id"`
+		Name      string         `json:"name"`
+		Size      uint64         `json:"size"`
+		Complete  bool           `json:"complete"`
+		Removed   bool           `json:"removed"`
+		Thumbnail *thumbnailInfo `json:"thumbnail,omitempty"`
+	}
+
 	type Message struct {
-		Message    string `json:"message"`
-		IsIncoming bool   `json:"isIncoming"`
-		IsAction   bool   `json:"isAction"`
-		Time       int64  `json:"time"`
+		Message    string    `json:"message"`
+		IsIncoming bool      `json:"isIncoming"`
+		IsAction   bool      `json:"isAction"`
+		Time       int64     `json:"time"`
+		File       *fileInfo `json:"file,omitempty"`
 	}
 
 	type friend struct {
@@ -26,26 +75,40 @@ func getFriendListJSON() (string, error) {
 		Online          bool      `json:"online"`
 	}
 
-	friend_ids, err := tox.SelfGetFriendlist()
+	var states []friendState
+	err := toxDo(func(t *gotox.Tox) (err error) {
+		states, err = getFriendStates(t)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
-	friends := make([]friend, len(friend_ids))
-	for i, friend_num := range friend_ids {
-		// TODO: handle errors
-		publicKey, _ := tox.FriendGetPublickey(friend_num)
-		name, _ := tox.FriendGetName(friend_num)
-		connected, _ := tox.FriendGetConnectionStatus(friend_num)
-		userstatus, _ := tox.FriendGetStatus(friend_num)
-		status_msg, _ := tox.FriendGetStatusMessage(friend_num)
+	friends := make([]friend, len(states))
+	for i, state := range states {
+		publicKey := state.publicKey
 		dbMessages := storage.GetMessages(hex.EncodeToString(publicKey), -1) // TOOD set a limit
 		dbLastMessageRead, _ := storage.GetLastMessageRead(hex.EncodeToString(publicKey))
 
 		var messages []Message
 
-		for _, msg := range dbMessages {
-			messages = append(messages, Message{Message: msg.Message, IsIncoming: msg.IsIncoming, IsAction: msg.IsAction, Time: msg.Time})
+		dbFiles := storage.GetFiles(hex.EncodeToString(publicKey), -1)
+
+		// merge messages and files (both are sorted by time, newest first)
+		for len(dbMessages) != 0 || len(dbFiles) != 0 {
+			if len(dbFiles) == 0 || (len(dbMessages) != 0 && dbMessages[0].Time >= dbFiles[0].Time) {
+				msg := dbMessages[0]
+				dbMessages = dbMessages[1:]
+				messages = append(messages, Message{Message: msg.Message, IsIncoming: msg.IsIncoming, IsAction: msg.IsAction, Time: msg.Time})
+			} else {
+				f := dbFiles[0]
+				dbFiles = dbFiles[1:]
+				file := &fileInfo{ID: f.ID, Name: f.FileName, Size: f.Size, Complete: f.Complete, Removed: len(f.StoredName) == 0}
+				if len(f.Thumbnail.StoredName) != 0 {
+					file.Thumbnail = &thumbnailInfo{Width: f.Thumbnail.Width, Height: f.Thumbnail.Height}
+				}
+				messages = append(messages, Message{Message: f.FileName, IsIncoming: f.IsIncoming, Time: f.Time, File: file})
+			}
 		}
 
 		if messages == nil {
@@ -53,14 +116,14 @@ func getFriendListJSON() (string, error) {
 		}
 
 		newfriend := friend{
-			Number:          friend_num,
+			Number:          state.number,
 			PublicKey:       hex.EncodeToString(publicKey),
 			Chat:            messages,
 			LastMessageRead: dbLastMessageRead,
-			Name:            name,
-			Status:          getUserStatusAsString(userstatus),
-			StatusMsg:       string(status_msg),
-			Online:          connected != gotox.TOX_CONNECTION_NONE,
+			Name:            state.name,
+			Status:          getUserStatusAsString(state.status),
+			StatusMsg:       string(state.statusMsg),
+			Online:          state.connection != gotox.TOX_CONNECTION_NONE,
 		}
 
 		friends[i] = newfriend
@@ -21,6 +21,24 @@ func rejectWithErrorJSON(w http.ResponseWriter, code string, message string) {
 	http.Error(w, string(jsonErr), 422)
 }
 
+// rejectWithStatusJSON writes an error encoded as JSON with the given HTTP
+// status code to a http.ResponseWriter
+// w        the http.ResponseWriter
+// status   the HTTP status code
+// code     an error code that identifies the error
+// message  a message explaining what went wrong (should be human readable)
+func rejectWithStatusJSON(w http.ResponseWriter, status int, code string, message string) {
+	type Err struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	e := Err{Code: code, Message: message}
+	jsonErr, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	http.Error(w, string(jsonErr), status)
+}
+
 // rejectWithDefaultErrorJSON writes a default error encoded as JSON to a
 // http.ResponseWriter. rejectWithDefaultErrorJSON(w) is equivalent to
 // rejectWithErrorJSON(w, "unknown", "An unknown error occoured."))
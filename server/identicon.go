@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+// the number of cells per row and column of an identicon, their size and the
+// border around them in pixels
+const (
+	IDENTICON_CELLS     int = 5
+	IDENTICON_CELL_SIZE int = 16
+	IDENTICON_BORDER    int = 8
+)
+
+// identicon returns a PNG image generated from a public key. It is shown for
+// friends without an avatar: a horizontally symmetric pattern of cells in a
+// color derived from the SHA-256 hash of the key, so the same friend always
+// gets the same image.
+// publicKey  the public key of the friend
+func identicon(publicKey []byte) []byte {
+	hash := sha256.Sum256(publicKey)
+
+	background := color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+	foreground := color.NRGBA{R: 0x30 + hash[0]%0xa0, G: 0x30 + hash[1]%0xa0, B: 0x30 + hash[2]%0xa0, A: 0xff}
+
+	size := IDENTICON_CELLS*IDENTICON_CELL_SIZE + 2*IDENTICON_BORDER
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	// the left half (including the middle column) is mirrored to the right
+	half := (IDENTICON_CELLS + 1) / 2
+	for y := 0; y < IDENTICON_CELLS; y++ {
+		for x := 0; x < half; x++ {
+			if hash[3+y*half+x]&1 == 0 {
+				continue
+			}
+
+			for _, column := range []int{x, IDENTICON_CELLS - 1 - x} {
+				cell := image.Rect(0, 0, IDENTICON_CELL_SIZE, IDENTICON_CELL_SIZE).Add(image.Pt(IDENTICON_BORDER+column*IDENTICON_CELL_SIZE, IDENTICON_BORDER+y*IDENTICON_CELL_SIZE))
+				draw.Draw(img, cell, &image.Uniform{foreground}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
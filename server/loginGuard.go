@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginFailures counts the failed logins of an address or an account
+type loginFailures struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// loginGuard limits failed logins per IP address and per account. After
+// CFG_LOGIN_FREE_ATTEMPTS failures, every further failure blocks the address
+// or account for an exponentially growing time. After CFG_LOGIN_MAX_ATTEMPTS
+// failures it is locked out for CFG_LOGIN_LOCKOUT_DURATION. Counters are reset
+// after a successful login or CFG_LOGIN_FAILURE_WINDOW without failures.
+type loginGuard struct {
+	sync.Mutex
+	addresses map[string]*loginFailures
+	accounts  map[string]*loginFailures
+}
+
+var logins = &loginGuard{
+	addresses: make(map[string]*loginFailures),
+	accounts:  make(map[string]*loginFailures),
+}
+
+// LoginBlock describes a blocked address or account
+type LoginBlock struct {
+	Type         string `json:"type"`
+	Key          string `json:"key"`
+	Failures     int    `json:"failures"`
+	BlockedUntil int64  `json:"blocked_until"`
+}
+
+// remoteIP returns the IP address of the client of a request
+// r  the request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accountKey returns the key used for counting the failed logins of an
+// account (usernames are truncated so arbitrary input cannot fill the memory)
+// account  the username
+func accountKey(account string) string {
+	if len(account) > 64 {
+		account = account[:64]
+	}
+	return strings.ToLower(account)
+}
+
+// attemptLogin checks the credentials of a login attempt unless the client or
+// the account is blocked. If it is, the time the block ends is returned.
+// r     the request
+// user  the username
+// pass  the password
+func attemptLogin(r *http.Request, user string, pass string) (bool, time.Time) {
+	address := remoteIP(r)
+	if until := logins.blocked(address, user); !until.IsZero() {
+		log.Println("[login] Blocked login attempt from", address)
+		return false, until
+	}
+
+	if !checkCredentials(user, pass) {
+		log.Println("[login] Login failed from", address)
+		logins.failure(address, user)
+		return false, time.Time{}
+	}
+
+	// with two-factor authentication the counters are reset after the second
+	// factor has been checked
+	if !isTOTPEnabled() {
+		logins.success(address, user)
+	}
+	return true, time.Time{}
+}
+
+// blocked returns the time until which the address or the account is blocked.
+// The zero time is returned if neither is blocked.
+// address  the IP address of the client
+// account  the username that is tried
+func (g *loginGuard) blocked(address string, account string) time.Time {
+	g.Lock()
+	defer g.Unlock()
+
+	var until time.Time
+	now := time.Now()
+	for _, f := range []*loginFailures{g.addresses[address], g.accounts[accountKey(account)]} {
+		if f != nil && f.blockedUntil.After(now) && f.blockedUntil.After(until) {
+			until = f.blockedUntil
+		}
+	}
+	return until
+}
+
+// failure records a failed login
+// address  the IP address of the client
+// account  the username that was tried
+func (g *loginGuard) failure(address string, account string) {
+	g.Lock()
+	g.prune()
+	addressUntil := g.record(g.addresses, address)
+	accountUntil := g.record(g.accounts, accountKey(account))
+	g.Unlock()
+
+	if !addressUntil.IsZero() {
+		g.notifyLockout("address", address, addressUntil)
+	}
+	if !accountUntil.IsZero() {
+		g.notifyLockout("account", accountKey(account), accountUntil)
+	}
+}
+
+// record increments the failure counter of key and blocks it if necessary.
+// Returns the end of the new block or the zero time if key has not been
+// blocked. Must be called with g locked.
+func (g *loginGuard) record(failures map[string]*loginFailures, key string) time.Time {
+	f := failures[key]
+	if f == nil {
+		f = &loginFailures{}
+		failures[key] = f
+	}
+
+	now := time.Now()
+	f.failures++
+	f.lastFailure = now
+
+	var until time.Time
+	if f.failures >= CFG_LOGIN_MAX_ATTEMPTS {
+		until = now.Add(CFG_LOGIN_LOCKOUT_DURATION)
+	} else if f.failures > CFG_LOGIN_FREE_ATTEMPTS {
+		until = now.Add(time.Second << uint(f.failures-CFG_LOGIN_FREE_ATTEMPTS-1))
+	}
+
+	if until.After(f.blockedUntil) {
+		f.blockedUntil = until
+		return until
+	}
+	return time.Time{}
+}
+
+// prune removes the counters that have not changed for
+// CFG_LOGIN_FAILURE_WINDOW. Must be called with g locked.
+func (g *loginGuard) prune() {
+	now := time.Now()
+	for _, failures := range []map[string]*loginFailures{g.addresses, g.accounts} {
+		for key, f := range failures {
+			if now.Sub(f.lastFailure) > CFG_LOGIN_FAILURE_WINDOW && now.After(f.blockedUntil) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// success resets the counters after a successful login
+// address  the IP address of the client
+// account  the username
+func (g *loginGuard) success(address string, account string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.addresses, address)
+	delete(g.accounts, accountKey(account))
+}
+
+// notifyLockout logs a lockout and notifies all connected clients
+// kind   "address" or "account"
+// key    the address or account
+// until  the end of the block
+func (g *loginGuard) notifyLockout(kind string, key string, until time.Time) {
+	log.Printf("[login] Too many failed logins, %s %s locked out for %s\n", kind, key, time.Until(until).Round(time.Second))
+
+	type lockoutEvent struct {
+		Type         string `json:"type"`
+		Kind         string `json:"kind"`
+		Key          string `json:"key"`
+		BlockedUntil int64  `json:"blocked_until"`
+	}
+
+	e, _ := json.Marshal(lockoutEvent{
+		Type:         "login_lockout",
+		Kind:         kind,
+		Key:          key,
+		BlockedUntil: until.Unix() * 1000,
+	})
+	broadcastToClients(string(e))
+}
+
+// list returns the currently blocked addresses and accounts
+func (g *loginGuard) list() []LoginBlock {
+	g.Lock()
+	defer g.Unlock()
+
+	blocks := []LoginBlock{}
+	now := time.Now()
+	for kind, failures := range map[string]map[string]*loginFailures{"address": g.addresses, "account": g.accounts} {
+		for key, f := range failures {
+			if f.blockedUntil.After(now) {
+				blocks = append(blocks, LoginBlock{Type: kind, Key: key, Failures: f.failures, BlockedUntil: f.blockedUntil.Unix() * 1000})
+			}
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].BlockedUntil > blocks[j].BlockedUntil
+	})
+	return blocks
+}
+
+// clear removes the block of an address or account. If key is empty, all
+// blocks are removed.
+// kind  "address" or "account"
+// key   the address or account
+func (g *loginGuard) clear(kind string, key string) {
+	g.Lock()
+	defer g.Unlock()
+
+	if len(key) == 0 {
+		g.addresses = make(map[string]*loginFailures)
+		g.accounts = make(map[string]*loginFailures)
+		return
+	}
+
+	switch kind {
+	case "address":
+		delete(g.addresses, key)
+	case "account":
+		delete(g.accounts, accountKey(key))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLoginGuard() *loginGuard {
+	return &loginGuard{
+		addresses: make(map[string]*loginFailures),
+		accounts:  make(map[string]*loginFailures),
+	}
+}
+
+func TestLoginGuardRecordReportsEveryBlock(t *testing.T) {
+	g := newTestLoginGuard()
+
+	for i := 1; i <= CFG_LOGIN_MAX_ATTEMPTS+3; i++ {
+		g.Lock()
+		until := g.record(g.addresses, "192.0.2.1")
+		g.Unlock()
+
+		switch {
+		case i <= CFG_LOGIN_FREE_ATTEMPTS:
+			if !until.IsZero() {
+				t.Errorf("failure %d: blocked until %s, want no block", i, until)
+			}
+		case i < CFG_LOGIN_MAX_ATTEMPTS:
+			want := time.Second << uint(i-CFG_LOGIN_FREE_ATTEMPTS-1)
+			if d := time.Until(until); d <= 0 || d > want {
+				t.Errorf("failure %d: blocked for %s, want %s", i, d, want)
+			}
+		default:
+			// every failure after the maximum extends the lockout
+			if d := time.Until(until); d <= CFG_LOGIN_LOCKOUT_DURATION-time.Minute || d > CFG_LOGIN_LOCKOUT_DURATION {
+				t.Errorf("failure %d: blocked for %s, want %s", i, d, CFG_LOGIN_LOCKOUT_DURATION)
+			}
+		}
+	}
+}
+
+func TestLoginGuardFailureBlocksAddressAndAccount(t *testing.T) {
+	g := newTestLoginGuard()
+
+	for i := 0; i <= CFG_LOGIN_FREE_ATTEMPTS; i++ {
+		g.failure("192.0.2.1", "Admin")
+	}
+
+	if g.blocked("192.0.2.1", "other").IsZero() {
+		t.Error("address not blocked")
+	}
+	if g.blocked("192.0.2.2", "admin").IsZero() {
+		t.Error("account not blocked")
+	}
+	if !g.blocked("192.0.2.2", "other").IsZero() {
+		t.Error("unrelated address and account blocked")
+	}
+
+	if blocks := g.list(); len(blocks) != 2 {
+		t.Errorf("%d blocks listed, want 2", len(blocks))
+	}
+
+	g.success("192.0.2.1", "admin")
+	if !g.blocked("192.0.2.1", "admin").IsZero() {
+		t.Error("still blocked after a successful login")
+	}
+}
@@ -23,7 +23,7 @@ package main
 import (
 	"./persistence"
 	"encoding/hex"
-	"flag"
+	"errors"
 	"fmt"
 	"github.com/codedust/go-httpserve"
 	"github.com/codedust/go-tox"
@@ -32,73 +32,129 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"time"
 )
 
-// the global tox instance
+// the global tox instance (must only be accessed from the main loop, see toxDo)
 var tox *gotox.Tox
 
 // the global connection to the database
 var storage *persistence.StorageConn
 
-// the global options for HTTP authentication
-var authOptions *httpserve.AuthOptions
-
+// FileTransfer is an active file transfer. fileID is the id of the file in the
+// database (0 for avatars), fileHandle is nil for empty avatar transfers.
+// Incoming data files are not accepted until the user or an auto-accept rule
+// accepts them, outgoing files until the friend accepts them.
 type FileTransfer struct {
-	fileHandle *os.File
-	fileSize   uint64
-	fileKind   gotox.ToxFileKind
+	friendNumber uint32
+	fileHandle   *os.File
+	fileSize     uint64
+	fileKind     gotox.ToxFileKind
+	fileID       int64
+	fileName     string
+	outgoing     bool
+
+	// the file ID chosen by the sender (hex encoded, only set for incoming
+	// files that can be resumed) and the time the position was last stored
+	toxFileID string
+	lastSaved time.Time
+
+	// the state (TRANSFER_*) and who paused the transfer
+	state          string
+	pausedByUs     bool
+	pausedByFriend bool
+
+	// the number of bytes transferred, the rate in bytes per second and the
+	// position and time of the last progress event
+	position     uint64
+	rate         float64
+	lastPosition uint64
+	lastProgress time.Time
 }
 
-// Map of active file transfers
-var transfers = make(map[uint32]FileTransfer)
+// the active file transfers (only changed from the main loop)
+var transfers = newTransferTable()
+
+// the savedata that was last written to disk successfully
+var lastSavedata []byte
+
+// saveRequests signals the main loop to write the Tox savedata to disk
+var saveRequests = make(chan bool, 1)
+
+// requestSave asks the main loop to save the Tox savedata as soon as possible.
+// Multiple requests that arrive before the next save are coalesced.
+func requestSave() {
+	select {
+	case saveRequests <- true:
+	default:
+	}
+}
 
 func main() {
+	if err := parseConfig(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := clientFilter.set(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	var newToxInstance bool = false
-	var options *gotox.Options
-	var databasePath string = filepath.Join(CFG_DATA_DIR, "userdata.db")
+	var databasePath string = filepath.Join(cfg.DataDir, "userdata.db")
 
 	var err error
 	storage, err = persistence.Open(databasePath)
 	if err != nil {
 		log.Panic("DB initialisation failed.")
 	}
-	defer storage.Close()
 
-	var toxSaveFilepath string
-	flag.StringVar(&toxSaveFilepath, "p", filepath.Join(CFG_DATA_DIR, "webtox_save"), "path to save file")
-	flag.Parse()
+	if err = os.MkdirAll(cfg.DownloadDir, 0700); err != nil {
+		log.Panic("Creating the download directory failed: ", err)
+	}
+	if err = os.MkdirAll(friendAvatarDir(), 0700); err != nil {
+		log.Panic("Creating the avatar directory failed: ", err)
+	}
+
+	toxSaveFilepath := cfg.SaveFile
 	fmt.Println("ToxData will be saved to", toxSaveFilepath)
 
+	initAuth()
+	if cfg.DisableTOTP && isTOTPEnabled() {
+		disableTOTP()
+	}
+	if err = sessions.init(cfg.SessionIdleTimeout.Duration, cfg.SessionMaxAge.Duration); err != nil {
+		log.Panic("Session initialisation failed: ", err)
+	}
+	loadToxSettings(&cfg.Tox)
+
+	// the key used to encrypt the save file (nil if it is not encrypted)
+	var saveKey *passKey
+
 	savedata, err := loadData(toxSaveFilepath)
-	if err == nil {
-		options = &gotox.Options{
-			IPv6Enabled:  true,
-			UDPEnabled:   true,
-			ProxyType:    gotox.TOX_PROXY_TYPE_NONE,
-			ProxyHost:    "127.0.0.1",
-			ProxyPort:    5555,
-			StartPort:    0,
-			EndPort:      0,
-			TcpPort:      CFG_TCP_PROXY_PORT,
-			SaveDataType: gotox.TOX_SAVEDATA_TYPE_TOX_SAVE,
-			SaveData:     savedata}
-	} else {
-		options = &gotox.Options{
-			IPv6Enabled:  true,
-			UDPEnabled:   true,
-			ProxyType:    gotox.TOX_PROXY_TYPE_NONE,
-			ProxyHost:    "127.0.0.1",
-			ProxyPort:    5555,
-			StartPort:    0,
-			EndPort:      0,
-			TcpPort:      CFG_TCP_PROXY_PORT,
-			SaveDataType: gotox.TOX_SAVEDATA_TYPE_NONE,
-			SaveData:     nil}
+	if err == nil && isDataEncrypted(savedata) {
+		savedata, saveKey, err = unlockSavedata(savedata, cfg.Passphrase)
+		if err != nil {
+			log.Fatal("Unlocking the Tox profile failed: ", err)
+		}
+		fmt.Println("Tox profile unlocked")
+	} else if len(cfg.Passphrase) != 0 {
+		fmt.Println("ToxData will be encrypted")
+		if saveKey, err = newPassKey(cfg.Passphrase); err != nil {
+			log.Fatal(err)
+		}
+		// make sure an unencrypted profile is replaced by an encrypted one
+		requestSave()
+	}
+
+	if savedata == nil {
 		newToxInstance = true
 	}
 
+	options := newToxOptions(&cfg.Tox, savedata)
 	tox, err = gotox.New(options)
 	if err != nil {
 		panic(err)
@@ -117,6 +173,7 @@ func main() {
 		tox.SelfSetName("WebTox User")
 		tox.SelfSetStatusMessage("WebToxing around...")
 		tox.SelfSetStatus(gotox.TOX_USERSTATUS_NONE)
+		requestSave()
 	} else {
 		name, err := tox.SelfGetName()
 		if err != nil {
@@ -139,87 +196,348 @@ func main() {
 		}
 	}
 
-	// Register our callbacks
-	tox.CallbackFriendRequest(onFriendRequest)
-	tox.CallbackFriendMessage(onFriendMessage)
-	tox.CallbackFriendConnectionStatusChanges(onFriendConnectionStatusChanges)
-	tox.CallbackFriendNameChanges(onFriendNameChanges)
-	tox.CallbackFriendStatusMessageChanges(onFriendStatusMessageChanges)
-	tox.CallbackFriendStatusChanges(onFriendStatusChanges)
-	tox.CallbackFileRecv(onFileRecv)
-	tox.CallbackFileRecvControl(onFileRecvControl)
-	tox.CallbackFileRecvChunk(onFileRecvChunk)
+	registerCallbacks(tox)
 
 	// Connect to the network
-	// TODO add more servers (as fallback)
-	pubkey, _ := hex.DecodeString("04119E835DF3E78BACF0F84235B300546AF8B936F035185E2A8E9E0A67C8924F")
-	err = tox.Bootstrap("144.76.60.215", 33445, pubkey)
-	if err != nil {
-		panic(err)
+	toxConfig := currentToxConfig()
+	bootstrap := newBootstrapper(cfg.NodesFile, &toxConfig)
+	if err = bootstrap.bootstrap(tox); err != nil {
+		log.Println("[main]", err)
 	}
 
 	// Start the server
-	go serveGUI()
+	gui, err := serveGUI()
+	if err != nil {
+		log.Println("[main] Starting the HTTPS server failed:", err)
+		shutdown(nil, toxSaveFilepath, saveKey)
+		os.Exit(1)
+	}
 
 	// Main loop
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	ticker := time.NewTicker(25 * time.Millisecond)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	iterateTimer := newIterationTimer()
+	saveTicker := time.NewTicker(cfg.SaveInterval.Duration)
+	bootstrapTicker := time.NewTicker(CFG_BOOTSTRAP_CHECK_INTERVAL)
+	cleanupTicker := time.NewTicker(CFG_DOWNLOAD_CLEANUP_INTERVAL)
+	cleanupDownloads()
 
 	for {
 		select {
-		case <-c:
-			fmt.Printf("\nSaving...\n")
-			if err := saveData(tox, toxSaveFilepath); err != nil {
-				fmt.Println(err)
+		case sig := <-c:
+			fmt.Printf("\nReceived %s, shutting down...\n", sig)
+			shutdown(gui, toxSaveFilepath, saveKey)
+			return
+
+		case err := <-gui.errors:
+			log.Println("[main] The HTTPS server failed:", err)
+			shutdown(gui, toxSaveFilepath, saveKey)
+			os.Exit(1)
+
+		case <-hup:
+			log.Println("[main] Received SIGHUP, reloading configuration")
+			if err := reloadConfig(gui, bootstrap); err != nil {
+				log.Println("[main] Reloading the configuration failed:", err)
 			}
+			saveTicker.Reset(cfg.SaveInterval.Duration)
 
-			fmt.Println("Killing")
-			tox.Kill()
-			return
+		case cmd := <-toxCommands:
+			cmd.run(tox)
+
+			// handle the work queued by the command within the interval
+			// recommended by toxcore, even in low-power mode
+			iterateTimer.hasten(toxIterationInterval(tox))
+
+		case req := <-toxRestartRequests:
+			err := restartTox(&req.config, bootstrap)
+			if err == nil {
+				setToxConfig(req.config)
+			}
+			req.result <- err
+
+		case <-saveRequests:
+			if err := saveData(tox, toxSaveFilepath, cfg.SaveBackups, saveKey); err != nil {
+				log.Println("[main] Saving failed:", err)
+			}
+
+		case <-saveTicker.C:
+			if err := saveData(tox, toxSaveFilepath, cfg.SaveBackups, saveKey); err != nil {
+				log.Println("[main] Saving failed:", err)
+			}
+
+		case <-bootstrapTicker.C:
+			status, _ := getSelfConnectionStatus()
+			bootstrap.check(tox, status)
+
+		case <-cleanupTicker.C:
+			cleanupDownloads()
 
-		case <-ticker.C:
-			tox.Iterate()
+		case <-iterateTimer.C:
+			iterateTimer.reset(iterate(tox))
 		}
 	}
 }
 
-func serveGUI() {
-	var err error
-	var user, pass, salt string
+// toxRestartRequest asks the main loop to recreate the Tox instance with a new
+// network configuration
+type toxRestartRequest struct {
+	config ToxConfig
+	result chan error
+}
+
+// toxRestartRequests is used to send restart requests to the main loop
+var toxRestartRequests = make(chan toxRestartRequest)
+
+// registerCallbacks registers our callbacks for the given Tox instance
+// t  the Tox instance
+func registerCallbacks(t *gotox.Tox) {
+	t.CallbackSelfConnectionStatusChanges(onSelfConnectionStatusChanges)
+	t.CallbackFriendRequest(onFriendRequest)
+	t.CallbackFriendMessage(onFriendMessage)
+	t.CallbackFriendConnectionStatusChanges(onFriendConnectionStatusChanges)
+	t.CallbackFriendNameChanges(onFriendNameChanges)
+	t.CallbackFriendStatusMessageChanges(onFriendStatusMessageChanges)
+	t.CallbackFriendStatusChanges(onFriendStatusChanges)
+	t.CallbackFileRecv(onFileRecv)
+	t.CallbackFileRecvControl(onFileRecvControl)
+	t.CallbackFileRecvChunk(onFileRecvChunk)
+	t.CallbackFileChunkRequest(onFileChunkRequest)
+}
+
+// restartTox replaces the global Tox instance by a new instance created with
+// the given network configuration. The savedata and callbacks are carried over.
+// If the new instance cannot be created, the previous configuration is
+// restored. Must only be called from the main loop.
+// c  the new Tox network configuration
+// b  the bootstrapper used to connect the new instance to the network
+func restartTox(c *ToxConfig, b *bootstrapper) error {
+	savedata, err := tox.GetSavedata()
+	if err != nil {
+		return err
+	}
+
+	oldConfig := currentToxConfig()
+
+	// file transfers are bound to the old instance, friends come online
+	// again in the new one
+	cancelTransfers(tox)
+	avatarSent = make(map[string]bool)
+	tox.Iterate()
 
-	user, err = storage.GetKeyValue("settings_auth_user")
+	// the old instance has to be killed first to free its ports
+	tox.Kill()
+
+	newTox, err := gotox.New(newToxOptions(c, savedata))
+	if err != nil {
+		log.Println("[main] Creating the Tox instance failed, restoring the previous settings:", err)
+		if tox, err = gotox.New(newToxOptions(&oldConfig, savedata)); err != nil {
+			panic(err)
+		}
+		registerCallbacks(tox)
+		onSelfConnectionStatusChanges(tox, gotox.TOX_CONNECTION_NONE)
+		b.ipv6 = oldConfig.IPv6Enabled
+		b.bootstrap(tox)
+		return errors.New("Creating the Tox instance failed")
+	}
+
+	tox = newTox
+	registerCallbacks(tox)
+	onSelfConnectionStatusChanges(tox, gotox.TOX_CONNECTION_NONE)
+
+	b.ipv6 = c.IPv6Enabled
+	if err = b.bootstrap(tox); err != nil {
+		log.Println("[main]", err)
+	}
+
+	log.Println("[main] Tox instance recreated with new network settings")
+	return nil
+}
+
+// newToxOptions returns the options used to create a Tox instance
+// c         the Tox network configuration
+// savedata  the savedata to load or nil to create a new Tox profile
+func newToxOptions(c *ToxConfig, savedata []byte) *gotox.Options {
+	proxyType, _ := getProxyTypeFromString(c.ProxyType)
+
+	options := &gotox.Options{
+		IPv6Enabled:  c.IPv6Enabled,
+		UDPEnabled:   c.UDPEnabled,
+		ProxyType:    proxyType,
+		ProxyHost:    c.ProxyHost,
+		ProxyPort:    uint16(c.ProxyPort),
+		StartPort:    uint16(c.StartPort),
+		EndPort:      uint16(c.EndPort),
+		TcpPort:      uint16(c.TCPPort),
+		SaveDataType: gotox.TOX_SAVEDATA_TYPE_NONE,
+		SaveData:     nil}
+
+	if savedata != nil {
+		options.SaveDataType = gotox.TOX_SAVEDATA_TYPE_TOX_SAVE
+		options.SaveData = savedata
+	}
+
+	return options
+}
+
+// initAuth makes sure credentials for the web interface exist. New
+// credentials are generated if none exist.
+func initAuth() {
+	_, err := storage.GetKeyValue("settings_auth_user")
 	if err == persistence.KeyNotFound {
-		user, pass, salt = storeDefaultHTTPAuth()
+		storeDefaultHTTPAuth()
+		return
 	} else if err != nil {
 		panic("GUI authentication username could not be determined.")
 	}
 
-	pass, err = storage.GetKeyValue("settings_auth_pass")
+	_, err = storage.GetKeyValue("settings_auth_pass")
 	if err == persistence.KeyNotFound {
-		user, pass, salt = storeDefaultHTTPAuth()
+		storeDefaultHTTPAuth()
 	} else if err != nil {
 		panic("GUI authentication password could not be determined.")
 	}
+}
 
-	salt, err = storage.GetKeyValue("settings_auth_salt")
-	if err == persistence.KeyNotFound {
-		user, pass, salt = storeDefaultHTTPAuth()
-	} else if err != nil {
-		panic("GUI authentication salt could not be determined.")
+// serveGUI starts the HTTPS server serving the web interface
+func serveGUI() (*guiServer, error) {
+	mux := http.NewServeMux()
+
+	// paths that require a session
+	mux.Handle("/events", requireSession(handleWS))
+	mux.Handle("/api/", requireSession(handleAPI))
+	mux.Handle("/", requireSession(http.FileServer(http.Dir(cfg.HTMLDir))))
+
+	// paths that *do not* require a session
+	mux.Handle("/login", handleLogin)
+	mux.Handle("/login/totp", handleLoginTOTP)
+	mux.Handle("/bootstrap/", http.FileServer(http.Dir(cfg.HTMLDir)))
+	mux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(filepath.Join(cfg.HTMLDir, "img")))))
+
+	httpserve.CreateCertificateIfNotExist(cfg.CertFile, cfg.KeyFile, "localhost", 3072)
+	return startGUIServer(restrictAddresses(mux))
+}
+
+// shutdown stops the HTTPS server, closes all WebSocket connections, cancels
+// active file transfers, saves the Tox profile and closes the database. Must
+// only be called from the main loop. Commands sent to the main loop are still
+// executed while the HTTPS server drains, so pending requests can complete.
+// gui       the HTTPS server (may be nil)
+// savePath  the path to the Tox save file
+// saveKey   the key used to encrypt the save file or nil
+func shutdown(gui *guiServer, savePath string, saveKey *passKey) {
+	if gui != nil {
+		fmt.Println("Stopping the HTTPS server...")
+		done := make(chan bool)
+		go func() {
+			if err := gui.shutdown(CFG_SHUTDOWN_TIMEOUT); err != nil {
+				log.Println("[shutdown]", err)
+			}
+			done <- true
+		}()
+
+		for draining := true; draining; {
+			select {
+			case <-done:
+				draining = false
+			case cmd := <-toxCommands:
+				cmd.run(tox)
+			case req := <-toxRestartRequests:
+				req.result <- errors.New("Shutting down")
+			}
+		}
 	}
 
-	authOptions = httpserve.NewAuthOptions(user, pass, salt)
-	mux := http.NewServeMux()
+	closeAllConnections()
+
+	cancelTransfers(tox)
+	tox.Iterate()
+
+	fmt.Println("Saving...")
+	if err := saveData(tox, savePath, cfg.SaveBackups, saveKey); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println("Killing")
+	tox.Kill()
+	storage.Close()
+}
+
+// cancelTransfers cancels all active file transfers and removes the
+// incomplete files. Accepted incoming files are kept so they can be resumed
+// when the friend offers them again. Must only be called from the main loop.
+// t  the Tox instance
+func cancelTransfers(t *gotox.Tox) {
+	for key, transfer := range transfers.snapshot() {
+		if isResumable(transfer) {
+			finishTransfer(key, transfer, TRANSFER_INTERRUPTED)
+			continue
+		}
+
+		t.FileControl(transfer.friendNumber, key.fileNumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		removeIncompleteFile(transfer)
+		transfers.remove(key)
+	}
+}
 
-	// paths that require authentication
-	mux.Handle("/events", httpserve.BasicAuthHandler(handleWS, authOptions))
-	mux.Handle("/api/", httpserve.BasicAuthHandler(handleAPI, authOptions))
-	mux.Handle("/", httpserve.BasicAuthHandler(http.FileServer(http.Dir(CFG_HTML_DIR)), authOptions))
+// reloadConfig reloads the configuration and the TLS certificate. Settings
+// that cannot be changed at runtime are reported and keep their old value.
+// Must only be called from the main loop.
+// gui  the HTTPS server
+// b    the bootstrapper
+func reloadConfig(gui *guiServer, b *bootstrapper) error {
+	newCfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err = gui.certs.load(newCfg.CertFile, newCfg.KeyFile); err != nil {
+		return err
+	}
+
+	restartRequired := map[string]bool{
+		"listen_addresses": !reflect.DeepEqual(newCfg.ListenAddresses, cfg.ListenAddresses),
+		"data_dir":         newCfg.DataDir != cfg.DataDir,
+		"html_dir":         newCfg.HTMLDir != cfg.HTMLDir,
+		"save_file":        newCfg.SaveFile != cfg.SaveFile,
+		"download_dir":     newCfg.DownloadDir != cfg.DownloadDir,
+		"max_request_size": newCfg.MaxRequestSize != cfg.MaxRequestSize,
+		"max_upload_size":  newCfg.MaxUploadSize != cfg.MaxUploadSize,
+		"password_hash":    newCfg.PasswordHash != cfg.PasswordHash,
+	}
+	for name, changed := range restartRequired {
+		if changed {
+			log.Println("[reloadConfig] Changing", name, "requires a restart")
+		}
+	}
+
+	if err = clientFilter.set(newCfg); err != nil {
+		return err
+	}
 
-	// paths that *do not* require authentication
-	mux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(CFG_IMG_DIR))))
+	cfg.CertFile = newCfg.CertFile
+	cfg.KeyFile = newCfg.KeyFile
+	cfg.SaveInterval = newCfg.SaveInterval
+	cfg.SaveBackups = newCfg.SaveBackups
+	cfg.LowPower = newCfg.LowPower
+	cfg.LowPowerInterval = newCfg.LowPowerInterval
+	cfg.DownloadQuota = newCfg.DownloadQuota
+	cfg.MaxFileSize = newCfg.MaxFileSize
+	cfg.DownloadMaxAge = newCfg.DownloadMaxAge
+	sessions.setTimeouts(newCfg.SessionIdleTimeout.Duration, newCfg.SessionMaxAge.Duration)
+
+	// settings changed in the web interface take precedence
+	loadToxSettings(&newCfg.Tox)
+	if oldToxConfig := currentToxConfig(); !reflect.DeepEqual(oldToxConfig, newCfg.Tox) {
+		b.userNodes = newCfg.Tox.BootstrapNodes
+		b.count = newCfg.Tox.BootstrapCount
+		if err = restartTox(&newCfg.Tox, b); err != nil {
+			return err
+		}
+		setToxConfig(newCfg.Tox)
+	}
 
-	httpserve.CreateCertificateIfNotExist(CFG_DATA_DIR+CFG_CERT_PREFIX+"cert.pem", CFG_DATA_DIR+CFG_CERT_PREFIX+"key.pem", "localhost", 3072)
-	err = httpserve.ListenAndUpgradeTLS(":8080", CFG_DATA_DIR+CFG_CERT_PREFIX+"cert.pem", CFG_DATA_DIR+CFG_CERT_PREFIX+"key.pem", mux)
+	log.Println("[reloadConfig] Configuration reloaded")
+	return nil
 }
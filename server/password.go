@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/codedust/go-httpserve"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Passwords are stored in a self-describing format:
+//
+//	$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+//	$2a$<cost>$<salt and hash>  (bcrypt)
+//
+// Older versions of WebTox stored Sha512Sum(password + salt) together with a
+// separate salt. These hashes are still accepted and replaced on the next
+// successful login.
+
+const (
+	PASSWORD_ARGON2ID    string = "argon2id"
+	PASSWORD_BCRYPT      string = "bcrypt"
+	PASSWORD_SALT_LENGTH int    = 16
+	PASSWORD_HASH_LENGTH uint32 = 32
+)
+
+var ErrInvalidPasswordHash = errors.New("Invalid password hash")
+
+// PasswordHashConfig holds the algorithm and cost used for hashing passwords
+type PasswordHashConfig struct {
+	Algorithm string `json:"algorithm"`
+
+	// memory is given in KiB
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+
+	BcryptCost int `json:"bcrypt_cost"`
+}
+
+// validate returns a list of problems with the password hash configuration
+func (c *PasswordHashConfig) validate() []string {
+	var errs []string
+
+	switch c.Algorithm {
+	case PASSWORD_ARGON2ID:
+		if c.Argon2Time < 1 {
+			errs = append(errs, "password_hash.argon2_time: must be at least 1")
+		}
+		if c.Argon2Threads < 1 {
+			errs = append(errs, "password_hash.argon2_threads: must be at least 1")
+		}
+		if c.Argon2Memory < 8*uint32(c.Argon2Threads) {
+			errs = append(errs, "password_hash.argon2_memory: must be at least 8 KiB per thread")
+		}
+	case PASSWORD_BCRYPT:
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			errs = append(errs, fmt.Sprintf("password_hash.bcrypt_cost: must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+		}
+	default:
+		errs = append(errs, "password_hash.algorithm: must be argon2id or bcrypt")
+	}
+
+	return errs
+}
+
+// hashPassword hashes a password using the given configuration
+// password  the plaintext password
+// c         the algorithm and cost to use
+func hashPassword(password string, c *PasswordHashConfig) (string, error) {
+	if c.Algorithm == PASSWORD_BCRYPT {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, c.Argon2Time, c.Argon2Memory, c.Argon2Threads, PASSWORD_HASH_LENGTH)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, c.Argon2Memory, c.Argon2Time, c.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// verifyPassword checks a password against a stored hash. needsRehash is true
+// if the password is correct but the hash uses an outdated algorithm or cost.
+// password    the plaintext password
+// stored      the stored hash
+// legacySalt  the salt of a legacy SHA-512 hash (empty for other hashes)
+// c           the current algorithm and cost
+func verifyPassword(password string, stored string, legacySalt string, c *PasswordHashConfig) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+
+		computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+		if subtle.ConstantTimeCompare(computed, hash) != 1 {
+			return false, false
+		}
+
+		return true, c.Algorithm != PASSWORD_ARGON2ID || memory != c.Argon2Memory || time != c.Argon2Time || threads != c.Argon2Threads
+
+	case strings.HasPrefix(stored, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+
+		cost, _ := bcrypt.Cost([]byte(stored))
+		return true, c.Algorithm != PASSWORD_BCRYPT || cost != c.BcryptCost
+
+	default:
+		// legacy salted SHA-512
+		if len(legacySalt) == 0 || subtle.ConstantTimeCompare([]byte(httpserve.Sha512Sum(password+legacySalt)), []byte(stored)) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+// storePassword hashes a password with the configured algorithm and stores it
+// password  the plaintext password
+func storePassword(password string) error {
+	hash, err := hashPassword(password, &cfg.PasswordHash)
+	if err != nil {
+		return err
+	}
+
+	if err = storage.StoreKeyValue("settings_auth_pass", hash); err != nil {
+		return err
+	}
+
+	// the salt is part of the hash now
+	return storage.StoreKeyValue("settings_auth_salt", "")
+}
@@ -10,7 +10,11 @@ import (
 )
 
 var (
-	KeyNotFound = errors.New("Key does not exist")
+	KeyNotFound      = errors.New("Key does not exist")
+	SessionNotFound  = errors.New("Session does not exist")
+	APITokenNotFound = errors.New("API token does not exist")
+	FileNotFound     = errors.New("File does not exist")
+	TransferNotFound = errors.New("File transfer does not exist")
 )
 
 type StorageConn struct {
@@ -25,6 +29,72 @@ type Message struct {
 	Time       int64
 }
 
+// Session is a login session of the web interface. Times are given in
+// milliseconds since the epoch.
+type Session struct {
+	ID        string
+	CSRFToken string
+	Created   int64
+	LastSeen  int64
+}
+
+// APIToken is a named token for accessing the API from scripts. Scopes and
+// Friends are comma separated lists. Times are given in milliseconds since the
+// epoch.
+type APIToken struct {
+	ID          int64
+	Name        string
+	TokenHash   string
+	Scopes      string
+	Friends     string
+	Created     int64
+	LastUsed    int64
+	LastAddress string
+}
+
+// File is a file received from or sent to a friend. FileName is the name
+// given by the sender, StoredName the name of the file on disk (empty if the
+// file has been removed).
+type File struct {
+	ID         int64
+	IsIncoming bool
+	FileName   string
+	StoredName string
+	Size       uint64
+	Time       int64
+	Complete   bool
+	Thumbnail  Thumbnail
+}
+
+// Thumbnail is a preview of an image file. StoredName is empty if there is no
+// thumbnail.
+type Thumbnail struct {
+	StoredName string
+	Width      int
+	Height     int
+}
+
+// the columns scanned by scanFile
+const fileColumns = `files.id, isIncoming, fileName, files.storedName, size, time, complete, thumbnails.storedName, thumbnails.width, thumbnails.height
+	FROM files LEFT JOIN thumbnails ON thumbnails.file = files.id`
+
+// Transfer is an accepted incoming file that has not been received completely.
+// ToxFileID is the file ID chosen by the sender (hex encoded) and Position the
+// number of bytes received.
+type Transfer struct {
+	File
+	ToxFileID string
+	Position  uint64
+}
+
+// FileUsage is the number and the total size of the stored files of a friend
+// (including their thumbnails)
+type FileUsage struct {
+	PublicKey string
+	Files     int
+	Size      uint64
+}
+
 type FriendRequest struct {
 	PublicKey string
 	Message   string
@@ -54,6 +124,28 @@ func Open(filename string) (*StorageConn, error) {
 		id INTEGER PRIMARY KEY,
 		publicKey TEXT
 	);
+	CREATE TABLE IF NOT EXISTS files (
+		id INTEGER PRIMARY KEY,
+		friend INTEGER,
+		isIncoming INTEGER,
+		fileName TEXT NOT NULL,
+		storedName TEXT NOT NULL,
+		size INTEGER,
+		time INTEGER,
+		complete INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS thumbnails (
+		file INTEGER PRIMARY KEY,
+		storedName TEXT NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		size INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS fileTransfers (
+		file INTEGER PRIMARY KEY,
+		toxFileId TEXT NOT NULL,
+		position INTEGER
+	);
 	CREATE TABLE IF NOT EXISTS friend_requests (
 		publicKey TEXT NOT NULL,
 		message TEXT NOT NULL,
@@ -67,6 +159,26 @@ func Open(filename string) (*StorageConn, error) {
 	CREATE TABLE IF NOT EXISTS keyValueStorage (
 		key TEXT PRIMARY KEY,
 		value TEXT
+	);
+	CREATE TABLE IF NOT EXISTS bootstrapNodes (
+		publicKey TEXT PRIMARY KEY,
+		lastSuccess INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS apiTokens (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		tokenHash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		friends TEXT NOT NULL,
+		created INTEGER,
+		lastUsed INTEGER,
+		lastAddress TEXT
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		csrfToken TEXT NOT NULL,
+		created INTEGER,
+		lastSeen INTEGER
 	);`
 
 	_, err = db.Exec(sqlStmt)
@@ -145,7 +257,7 @@ func (s *StorageConn) StoreMessage(friendPublicKey string, isIncoming bool, isAc
 // GetMessages returns previously stored messages of a friend.
 // friendPublicKey  the publicKey of the friend
 // limit            the number of messages that should be returned. Set limit
-//                  to -1 to get all messages
+// to -1 to get all messages
 func (s *StorageConn) GetMessages(friendPublicKey string, limit int) []Message {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -181,6 +293,328 @@ func (s *StorageConn) GetMessages(friendPublicKey string, limit int) []Message {
 	return messages
 }
 
+// StoreFile stores the metadata of a file and returns its id
+// friendPublicKey  the publicKey of the friend
+// isIncoming       specifies if the file is received (true) or sent (false)
+// fileName         the name of the file given by the sender
+// storedName       the name of the file on disk
+// size             the size of the file
+func (s *StorageConn) StoreFile(friendPublicKey string, isIncoming bool, fileName string, storedName string, size uint64) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	friendID, err := s.getFriendDbId(friendPublicKey)
+	if err != nil {
+		return -1, err
+	}
+
+	result, err := s.db.Exec(`INSERT INTO files(friend, isIncoming, fileName, storedName, size, time, complete) VALUES(?, ?, ?, ?, ?, ?, 0)`, friendID, isIncoming, fileName, storedName, int64(size), time.Now().Unix()*1000)
+	if err != nil {
+		log.Print("[persistence StoreFile] INSERT statement failed")
+		return -1, err
+	}
+	return result.LastInsertId()
+}
+
+// SetFileComplete marks a file as completely transferred
+// id  the id of the file
+func (s *StorageConn) SetFileComplete(id int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE files SET complete = 1 WHERE id = ?`, id)
+	if err != nil {
+		log.Print("[persistence SetFileComplete] UPDATE statement failed")
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM fileTransfers WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence SetFileComplete] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// RenameFile changes the name of a file shown to the user
+// id        the id of the file
+// fileName  the new name
+func (s *StorageConn) RenameFile(id int64, fileName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE files SET fileName = ? WHERE id = ?`, fileName, id)
+	if err != nil {
+		log.Print("[persistence RenameFile] UPDATE statement failed")
+		return err
+	}
+	return nil
+}
+
+// GetFile returns the file with the given id or FileNotFound
+// id  the id of the file
+func (s *StorageConn) GetFile(id int64) (File, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT "+fileColumns+" WHERE files.id = ?", id)
+	if err != nil {
+		log.Print("[persistence GetFile] SELECT statement failed")
+		return File{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return File{}, FileNotFound
+	}
+
+	return scanFile(rows)
+}
+
+// GetFiles returns the files of a friend, newest first
+// friendPublicKey  the publicKey of the friend
+// limit            the number of files that should be returned (-1 for all)
+func (s *StorageConn) GetFiles(friendPublicKey string, limit int) []File {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	friendID, err := s.getFriendDbId(friendPublicKey)
+	if err != nil {
+		log.Print("[persistence GetFiles] getFriendDbId failed")
+		return nil
+	}
+
+	rows, err := s.db.Query("SELECT "+fileColumns+" WHERE friend = ? ORDER BY files.id DESC LIMIT ?", friendID, limit)
+	if err != nil {
+		log.Print("[persistence GetFiles] SELECT statement failed")
+		return nil
+	}
+	defer rows.Close()
+
+	var files []File
+
+	for rows.Next() {
+		f, _ := scanFile(rows)
+		files = append(files, f)
+	}
+
+	return files
+}
+
+// DeleteFile deletes the metadata of a file
+// id  the id of the file
+func (s *StorageConn) DeleteFile(id int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM files WHERE id = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteFile] DELETE statement failed")
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM fileTransfers WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteFile] DELETE statement failed")
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM thumbnails WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteFile] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// StoreThumbnail stores the thumbnail of an image file. Returns FileNotFound
+// if the file has been deleted or removed from disk in the meantime.
+// id          the id of the file
+// storedName  the name of the thumbnail on disk
+// width       the width of the thumbnail
+// height      the height of the thumbnail
+// size        the size of the thumbnail in bytes
+func (s *StorageConn) StoreThumbnail(id int64, storedName string, width int, height int, size uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res, err := s.db.Exec(`INSERT OR REPLACE INTO thumbnails(file, storedName, width, height, size) SELECT ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM files WHERE id = ? AND storedName != '')`, id, storedName, width, height, size, id)
+	if err != nil {
+		log.Print("[persistence StoreThumbnail] INSERT statement failed")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return FileNotFound
+	}
+	return nil
+}
+
+// DeleteThumbnail deletes the thumbnail of a file. Returns the name of the
+// thumbnail on disk (empty if there is none).
+// id  the id of the file
+func (s *StorageConn) DeleteThumbnail(id int64) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query(`SELECT storedName FROM thumbnails WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteThumbnail] SELECT statement failed")
+		return "", err
+	}
+
+	var storedName string
+	if rows.Next() {
+		rows.Scan(&storedName)
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(`DELETE FROM thumbnails WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteThumbnail] DELETE statement failed")
+		return "", err
+	}
+	return storedName, nil
+}
+
+// SetFileRemoved marks a file as removed from disk. The metadata is kept for
+// the chat history. Its thumbnail has to be deleted using DeleteThumbnail
+// afterwards.
+// id  the id of the file
+func (s *StorageConn) SetFileRemoved(id int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE files SET storedName = '' WHERE id = ?`, id)
+	if err != nil {
+		log.Print("[persistence SetFileRemoved] UPDATE statement failed")
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM fileTransfers WHERE file = ?`, id)
+	if err != nil {
+		log.Print("[persistence SetFileRemoved] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// GetFileUsage returns the number and the size of the files stored on disk
+// for each friend. Incomplete files are counted with their full size,
+// thumbnails are added to the size of their file.
+func (s *StorageConn) GetFileUsage() []FileUsage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT publicKey, COUNT(*), SUM(files.size) + IFNULL(SUM(thumbnails.size), 0) AS total FROM files JOIN friends ON files.friend = friends.id LEFT JOIN thumbnails ON thumbnails.file = files.id WHERE files.storedName != '' GROUP BY publicKey ORDER BY total DESC")
+	if err != nil {
+		log.Print("[persistence GetFileUsage] SELECT statement failed")
+		return nil
+	}
+	defer rows.Close()
+
+	var usage []FileUsage
+
+	for rows.Next() {
+		var u FileUsage
+		var size int64
+		rows.Scan(&u.PublicKey, &u.Files, &size)
+		u.Size = uint64(size)
+		usage = append(usage, u)
+	}
+
+	return usage
+}
+
+// GetStaleFiles returns the stored files that are older than the given time
+// and the incomplete files that cannot be resumed. Set before to 0 to only
+// return incomplete files.
+// before  the time in milliseconds since the epoch
+func (s *StorageConn) GetStaleFiles(before int64) []File {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT "+fileColumns+" WHERE files.storedName != '' AND (time < ? OR (complete = 0 AND files.id NOT IN (SELECT file FROM fileTransfers)))", before)
+	if err != nil {
+		log.Print("[persistence GetStaleFiles] SELECT statement failed")
+		return nil
+	}
+	defer rows.Close()
+
+	var files []File
+
+	for rows.Next() {
+		f, _ := scanFile(rows)
+		files = append(files, f)
+	}
+
+	return files
+}
+
+// StoreTransfer remembers an accepted incoming file so that it can be resumed
+// if the transfer is interrupted. Nothing is changed if the file is already
+// stored.
+// id         the id of the file
+// toxFileID  the file ID chosen by the sender (hex encoded)
+func (s *StorageConn) StoreTransfer(id int64, toxFileID string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO fileTransfers(file, toxFileId, position) VALUES(?, ?, 0)`, id, toxFileID)
+	if err != nil {
+		log.Print("[persistence StoreTransfer] INSERT statement failed")
+		return err
+	}
+	return nil
+}
+
+// SetTransferPosition stores the number of bytes received of a file
+// id        the id of the file
+// position  the number of bytes received
+func (s *StorageConn) SetTransferPosition(id int64, position uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE fileTransfers SET position = ? WHERE file = ?`, int64(position), id)
+	if err != nil {
+		log.Print("[persistence SetTransferPosition] UPDATE statement failed")
+		return err
+	}
+	return nil
+}
+
+// GetTransfer returns the incomplete file a friend has sent with the given
+// file ID or TransferNotFound
+// friendPublicKey  the publicKey of the friend
+// toxFileID        the file ID chosen by the sender (hex encoded)
+func (s *StorageConn) GetTransfer(friendPublicKey string, toxFileID string) (Transfer, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	friendID, err := s.getFriendDbId(friendPublicKey)
+	if err != nil {
+		log.Print("[persistence GetTransfer] getFriendDbId failed")
+		return Transfer{}, err
+	}
+
+	rows, err := s.db.Query("SELECT id, isIncoming, fileName, storedName, size, time, complete, toxFileId, position FROM files JOIN fileTransfers ON fileTransfers.file = files.id WHERE friend = ? AND toxFileId = ? AND complete = 0", friendID, toxFileID)
+	if err != nil {
+		log.Print("[persistence GetTransfer] SELECT statement failed")
+		return Transfer{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Transfer{}, TransferNotFound
+	}
+
+	var t Transfer
+	var size, position int64
+	err = rows.Scan(&t.ID, &t.IsIncoming, &t.FileName, &t.StoredName, &size, &t.Time, &t.Complete, &t.ToxFileID, &position)
+	t.Size = uint64(size)
+	t.Position = uint64(position)
+	return t, err
+}
+
 // StoreFriendRequest stores a friend request
 // friendPublicKey  the publicKey of the friend request
 // message          the message send with the friend request
@@ -198,7 +632,7 @@ func (s *StorageConn) StoreFriendRequest(friendPublicKey string, message string)
 
 // GetFriendRequests returns previously stored friend requests.
 // limit  the number of friend requests that should be returned. Set limit to
-//        -1 to get all messages
+// -1 to get all messages
 func (s *StorageConn) GetFriendRequests(limit int) []FriendRequest {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -299,6 +733,245 @@ func (s *StorageConn) GetLastMessageRead(friendPublicKey string) (int64, error)
 	return 0, nil
 }
 
+// StoreWorkingBootstrapNode records that bootstrapping against a node was
+// successful
+// publicKey  the publicKey of the bootstrap node
+func (s *StorageConn) StoreWorkingBootstrapNode(publicKey string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO bootstrapNodes(publicKey, lastSuccess) VALUES(?, ?)`, publicKey, time.Now().Unix()*1000)
+	if err != nil {
+		log.Print("[persistence StoreWorkingBootstrapNode] INSERT statement failed")
+		return err
+	}
+	return nil
+}
+
+// GetWorkingBootstrapNodes returns the publicKeys of the bootstrap nodes that
+// worked before, most recent first
+// limit  the number of nodes that should be returned. Set limit to -1 to get
+// all nodes
+func (s *StorageConn) GetWorkingBootstrapNodes(limit int) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT publicKey FROM bootstrapNodes ORDER BY lastSuccess DESC LIMIT ?", limit)
+	if err != nil {
+		log.Print("[persistence GetWorkingBootstrapNodes] SELECT statement failed")
+		return nil
+	}
+	defer rows.Close()
+
+	var publicKeys []string
+
+	for rows.Next() {
+		var publicKey string
+		rows.Scan(&publicKey)
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	return publicKeys
+}
+
+// StoreAPIToken stores a new API token and returns its id
+// token  the token (ID is ignored)
+func (s *StorageConn) StoreAPIToken(token APIToken) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	result, err := s.db.Exec(`INSERT INTO apiTokens(name, tokenHash, scopes, friends, created, lastUsed, lastAddress) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		token.Name, token.TokenHash, token.Scopes, token.Friends, token.Created, token.LastUsed, token.LastAddress)
+	if err != nil {
+		log.Print("[persistence StoreAPIToken] INSERT statement failed")
+		return -1, err
+	}
+	return result.LastInsertId()
+}
+
+// GetAPIToken returns the API token with the given hash or APITokenNotFound
+// tokenHash  the hash of the token
+func (s *StorageConn) GetAPIToken(tokenHash string) (APIToken, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT id, name, tokenHash, scopes, friends, created, lastUsed, lastAddress FROM apiTokens WHERE tokenHash = ?", tokenHash)
+	if err != nil {
+		log.Print("[persistence GetAPIToken] SELECT statement failed")
+		return APIToken{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return APIToken{}, APITokenNotFound
+	}
+
+	var t APIToken
+	err = rows.Scan(&t.ID, &t.Name, &t.TokenHash, &t.Scopes, &t.Friends, &t.Created, &t.LastUsed, &t.LastAddress)
+	return t, err
+}
+
+// GetAPITokens returns all API tokens, oldest first
+func (s *StorageConn) GetAPITokens() []APIToken {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT id, name, tokenHash, scopes, friends, created, lastUsed, lastAddress FROM apiTokens ORDER BY created")
+	if err != nil {
+		log.Print("[persistence GetAPITokens] SELECT statement failed")
+		return nil
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+
+	for rows.Next() {
+		var t APIToken
+		rows.Scan(&t.ID, &t.Name, &t.TokenHash, &t.Scopes, &t.Friends, &t.Created, &t.LastUsed, &t.LastAddress)
+		tokens = append(tokens, t)
+	}
+
+	return tokens
+}
+
+// TouchAPIToken records when and from where an API token was last used
+// id        the id of the token
+// lastUsed  the time the token was used
+// address   the IP address the token was used from
+func (s *StorageConn) TouchAPIToken(id int64, lastUsed int64, address string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE apiTokens SET lastUsed = ?, lastAddress = ? WHERE id = ?`, lastUsed, address, id)
+	if err != nil {
+		log.Print("[persistence TouchAPIToken] UPDATE statement failed")
+		return err
+	}
+	return nil
+}
+
+// DeleteAPIToken revokes an API token
+// id  the id of the token
+func (s *StorageConn) DeleteAPIToken(id int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM apiTokens WHERE id = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteAPIToken] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// StoreSession stores a new session
+// session  the session
+func (s *StorageConn) StoreSession(session Session) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`INSERT INTO sessions(id, csrfToken, created, lastSeen) VALUES(?, ?, ?, ?)`, session.ID, session.CSRFToken, session.Created, session.LastSeen)
+	if err != nil {
+		log.Print("[persistence StoreSession] INSERT statement failed")
+		return err
+	}
+	return nil
+}
+
+// GetSession returns the session with the given id or SessionNotFound
+// id  the id of the session
+func (s *StorageConn) GetSession(id string) (Session, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	rows, err := s.db.Query("SELECT id, csrfToken, created, lastSeen FROM sessions WHERE id = ?", id)
+	if err != nil {
+		log.Print("[persistence GetSession] SELECT statement failed")
+		return Session{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Session{}, SessionNotFound
+	}
+
+	var session Session
+	err = rows.Scan(&session.ID, &session.CSRFToken, &session.Created, &session.LastSeen)
+	return session, err
+}
+
+// TouchSession updates the time a session was last used
+// id        the id of the session
+// lastSeen  the time the session was last used
+func (s *StorageConn) TouchSession(id string, lastSeen int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`UPDATE sessions SET lastSeen = ? WHERE id = ?`, lastSeen, id)
+	if err != nil {
+		log.Print("[persistence TouchSession] UPDATE statement failed")
+		return err
+	}
+	return nil
+}
+
+// DeleteSession deletes a session
+// id  the id of the session
+func (s *StorageConn) DeleteSession(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteSession] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// DeleteOtherSessions deletes all sessions except the given one
+// id  the id of the session to keep (may be empty)
+func (s *StorageConn) DeleteOtherSessions(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id != ?`, id)
+	if err != nil {
+		log.Print("[persistence DeleteOtherSessions] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// DeleteExpiredSessions deletes all sessions that were last used before
+// idleBefore or created before createdBefore
+// idleBefore     sessions last used before this time are deleted
+// createdBefore  sessions created before this time are deleted
+func (s *StorageConn) DeleteExpiredSessions(idleBefore int64, createdBefore int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE lastSeen < ? OR created < ?`, idleBefore, createdBefore)
+	if err != nil {
+		log.Print("[persistence DeleteExpiredSessions] DELETE statement failed")
+		return err
+	}
+	return nil
+}
+
+// scanFile reads a file selected with fileColumns
+// rows  the result of the query
+func scanFile(rows *sql.Rows) (File, error) {
+	var f File
+	var size int64
+	var thumbnail sql.NullString
+	var width, height sql.NullInt64
+	err := rows.Scan(&f.ID, &f.IsIncoming, &f.FileName, &f.StoredName, &size, &f.Time, &f.Complete, &thumbnail, &width, &height)
+	f.Size = uint64(size)
+	f.Thumbnail = Thumbnail{StoredName: thumbnail.String, Width: int(width.Int64), Height: int(height.Int64)}
+	return f, err
+}
+
 // getFriendDbId returns the friendId that is used internally in the database
 // for the friend with the given publicKey
 // friendPublicKey  the publicKey of the friend
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/codedust/go-tox"
+	"sync"
+	"time"
+)
+
+// iterationStats holds information about the scheduling of tox.Iterate()
+var iterationStats = struct {
+	sync.Mutex
+	interval   time.Duration
+	iterations uint64
+	lowPower   bool
+}{}
+
+// iterate calls t.Iterate() and returns the time to wait before the next
+// iteration. The interval recommended by toxcore is used, unless low-power
+// mode is enabled and no web client is connected, in which case the interval
+// is lengthened to cfg.LowPowerInterval. Must only be called from the main
+// loop.
+// t  the Tox instance
+func iterate(t *gotox.Tox) time.Duration {
+	t.Iterate()
+
+	interval := toxIterationInterval(t)
+	lowPower := cfg.LowPower && len(getActiveConnections()) == 0
+	if lowPower && interval < cfg.LowPowerInterval.Duration {
+		interval = cfg.LowPowerInterval.Duration
+	}
+
+	iterationStats.Lock()
+	iterationStats.interval = interval
+	iterationStats.iterations++
+	iterationStats.lowPower = lowPower
+	iterationStats.Unlock()
+
+	return interval
+}
+
+// toxIterationInterval returns the iteration interval recommended by toxcore.
+// Must only be called from the main loop.
+// t  the Tox instance
+func toxIterationInterval(t *gotox.Tox) time.Duration {
+	if ms, err := t.IterationInterval(); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return CFG_DEFAULT_ITERATION_INTERVAL
+}
+
+// iterationTimer is the timer scheduling the calls of iterate
+type iterationTimer struct {
+	*time.Timer
+	next time.Time
+}
+
+// newIterationTimer returns a timer that fires immediately
+func newIterationTimer() *iterationTimer {
+	return &iterationTimer{Timer: time.NewTimer(0), next: time.Now()}
+}
+
+// reset sets the timer to fire after d. A fire that has not been received yet
+// is discarded.
+// d  the time until the next iteration
+func (it *iterationTimer) reset(d time.Duration) {
+	if !it.Stop() {
+		select {
+		case <-it.C:
+		default:
+		}
+	}
+	it.Reset(d)
+	it.next = time.Now().Add(d)
+}
+
+// hasten makes sure the timer fires within d. The next iteration is never
+// postponed, so a steady stream of commands cannot delay it.
+// d  the maximum time until the next iteration
+func (it *iterationTimer) hasten(d time.Duration) {
+	if time.Until(it.next) > d {
+		it.reset(d)
+	}
+}
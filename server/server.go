@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guiServer is the HTTPS server serving the web interface on all configured
+// listen addresses. Plain HTTP requests on the same port are redirected to
+// HTTPS.
+type guiServer struct {
+	server *http.Server
+	certs  *certStore
+
+	// errors reports a failure of the server after it has been started
+	errors chan error
+}
+
+// startGUIServer starts serving handler on the configured listen addresses.
+// An error is returned if a listener could not be created.
+// handler  the handler for all requests
+func startGUIServer(handler http.Handler) (*guiServer, error) {
+	certs := &certStore{}
+	if err := certs.load(cfg.CertFile, cfg.KeyFile); err != nil {
+		return nil, err
+	}
+
+	s := &guiServer{
+		server: &http.Server{Handler: handler},
+		certs:  certs,
+		errors: make(chan error, 1),
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: certs.getCertificate}
+
+	var listeners []net.Listener
+	for _, address := range cfg.ListenAddresses {
+		ln, err := listen(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, newUpgradeListener(ln, tlsConfig))
+	}
+
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				select {
+				case s.errors <- err:
+				default:
+				}
+			}
+		}(ln)
+	}
+
+	log.Println("[server] Listening on", strings.Join(cfg.ListenAddresses, ", "))
+	return s, nil
+}
+
+// listen creates a listener for a TCP address or a Unix socket
+// address  "host:port" or "unix:<path>"
+func listen(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, "unix:")
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+
+	// remove a stale socket left behind by a previous run
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// shutdown stops accepting new connections and waits for active requests to
+// complete (at most timeout)
+// timeout  the maximum time to wait
+func (s *guiServer) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// certStore holds the TLS certificate, which can be replaced at runtime
+type certStore struct {
+	mtx  sync.Mutex
+	cert *tls.Certificate
+}
+
+// load (re)loads the certificate from the given files
+// certFile  the path to the certificate
+// keyFile   the path to the private key
+func (s *certStore) load(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.cert = &cert
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cert, nil
+}
+
+// upgradeListener accepts TLS connections and redirects plain HTTP
+// connections to HTTPS. Connections from clients that are not allowed by
+// clientFilter are closed right away.
+type upgradeListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// newUpgradeListener wraps ln and starts accepting connections
+// ln         the underlying listener
+// tlsConfig  the TLS configuration for TLS connections
+func newUpgradeListener(ln net.Listener, tlsConfig *tls.Config) *upgradeListener {
+	l := &upgradeListener{
+		Listener:  ln,
+		tlsConfig: tlsConfig,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *upgradeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.closeWithError(err)
+			return
+		}
+
+		// denied clients do not get a TLS handshake or a redirect
+		if !clientFilter.allowed(conn.RemoteAddr().String()) {
+			log.Println("[server] Denied connection from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go l.sniff(conn)
+	}
+}
+
+// sniff peeks at the first byte of a connection to tell TLS handshakes from
+// plain HTTP requests
+func (l *upgradeListener) sniff(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	pc := &peekedConn{Conn: conn, r: br}
+
+	// 0x16 is the record type of a TLS handshake
+	if first[0] != 0x16 {
+		redirectToHTTPS(pc)
+		return
+	}
+
+	select {
+	case l.conns <- tls.Server(pc, l.tlsConfig):
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *upgradeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *upgradeListener) Close() error {
+	return l.closeWithError(nil)
+}
+
+// closeWithError closes the listener. Accept returns acceptErr afterwards.
+func (l *upgradeListener) closeWithError(acceptErr error) error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.err = acceptErr
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekedConn is a connection whose first bytes have already been read into r
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// redirectToHTTPS answers a single plain HTTP request with a redirect to the
+// same URL using HTTPS and closes the connection
+func redirectToHTTPS(conn *peekedConn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusMovedPermanently,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Location": {"https://" + req.Host + req.URL.RequestURI()}, "Connection": {"close"}},
+		Close:      true,
+	}
+	resp.Write(conn)
+}
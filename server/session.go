@@ -0,0 +1,344 @@
+package main
+
+import (
+	"./persistence"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSession      = errors.New("No valid session")
+	ErrSessionExpired = errors.New("Session expired")
+)
+
+// sessionManager manages the login sessions of the web interface. Sessions are
+// stored in the database by the SHA-256 hash of their token. The session
+// cookie contains the token together with an HMAC, so forged cookies are
+// rejected without a database lookup.
+type sessionManager struct {
+	sync.Mutex
+	secret      []byte
+	idleTimeout time.Duration
+	maxAge      time.Duration
+}
+
+var sessions = &sessionManager{}
+
+// init loads the secret used to sign session cookies from the database and
+// removes expired sessions. A new secret is generated if none exists.
+// idleTimeout  see setTimeouts
+// maxAge       see setTimeouts
+func (m *sessionManager) init(idleTimeout time.Duration, maxAge time.Duration) error {
+	secret, err := storage.GetKeyValue("settings_session_secret")
+	if err == persistence.KeyNotFound {
+		secret, err = randomToken(32)
+		if err != nil {
+			return err
+		}
+		if err = storage.StoreKeyValue("settings_session_secret", secret); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	m.Lock()
+	m.secret = []byte(secret)
+	m.Unlock()
+
+	m.setTimeouts(idleTimeout, maxAge)
+	m.deleteExpired()
+	return nil
+}
+
+// setTimeouts sets the session timeouts
+// idleTimeout  sessions expire after being unused for this long
+// maxAge       sessions expire this long after they were created
+func (m *sessionManager) setTimeouts(idleTimeout time.Duration, maxAge time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.idleTimeout = idleTimeout
+	m.maxAge = maxAge
+}
+
+func (m *sessionManager) timeouts() (time.Duration, time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	return m.idleTimeout, m.maxAge
+}
+
+// sign returns the HMAC of a session token
+// token  the session token
+func (m *sessionManager) sign(token string) string {
+	m.Lock()
+	mac := hmac.New(sha256.New, m.secret)
+	m.Unlock()
+
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// create starts a new session and sets the session and CSRF cookies
+// w  the response the cookies are added to
+func (m *sessionManager) create(w http.ResponseWriter) (*persistence.Session, error) {
+	m.deleteExpired()
+
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix() * 1000
+	session := persistence.Session{ID: hashToken(token), CSRFToken: csrfToken, Created: now, LastSeen: now}
+	if err = storage.StoreSession(session); err != nil {
+		return nil, err
+	}
+
+	_, maxAge := m.timeouts()
+	http.SetCookie(w, &http.Cookie{
+		Name:     CFG_SESSION_COOKIE,
+		Value:    token + "." + m.sign(token),
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// the CSRF cookie is read by the web interface and sent back in the
+	// CFG_CSRF_HEADER header (see $http in AngularJS)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CFG_CSRF_COOKIE,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return &session, nil
+}
+
+// get returns the session of a request. Expired sessions are deleted.
+// r  the request
+func (m *sessionManager) get(r *http.Request) (*persistence.Session, error) {
+	cookie, err := r.Cookie(CFG_SESSION_COOKIE)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(m.sign(parts[0]))) {
+		return nil, ErrNoSession
+	}
+
+	session, err := storage.GetSession(hashToken(parts[0]))
+	if err == persistence.SessionNotFound {
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	idleTimeout, maxAge := m.timeouts()
+	now := time.Now()
+	lastSeen := time.Unix(0, session.LastSeen*int64(time.Millisecond))
+	created := time.Unix(0, session.Created*int64(time.Millisecond))
+
+	if now.Sub(lastSeen) > idleTimeout || now.Sub(created) > maxAge {
+		storage.DeleteSession(session.ID)
+		return nil, ErrSessionExpired
+	}
+
+	// avoid writing to the database on every request
+	if now.Sub(lastSeen) > time.Minute {
+		session.LastSeen = now.Unix() * 1000
+		storage.TouchSession(session.ID, session.LastSeen)
+	}
+
+	return &session, nil
+}
+
+// destroy ends the session of a request and clears the cookies
+// w  the response the cookies are cleared in
+// r  the request
+func (m *sessionManager) destroy(w http.ResponseWriter, r *http.Request) error {
+	session, err := m.get(r)
+	if err == nil {
+		err = storage.DeleteSession(session.ID)
+	}
+
+	for _, name := range []string{CFG_SESSION_COOKIE, CFG_CSRF_COOKIE} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, Secure: true})
+	}
+
+	return err
+}
+
+// destroyOthers ends all sessions except the session of the given request
+// (e.g. after the password has been changed)
+// r  the request
+func (m *sessionManager) destroyOthers(r *http.Request) error {
+	var id string
+	if session, err := m.get(r); err == nil {
+		id = session.ID
+	}
+	return storage.DeleteOtherSessions(id)
+}
+
+func (m *sessionManager) deleteExpired() {
+	idleTimeout, maxAge := m.timeouts()
+	now := time.Now()
+	storage.DeleteExpiredSessions(now.Add(-idleTimeout).Unix()*1000, now.Add(-maxAge).Unix()*1000)
+}
+
+// requireSession wraps h so that it is only served to requests with a valid
+// session or API token (see serveWithAPIToken). State-changing requests and
+// WebSocket handshakes of sessions additionally have to present the CSRF
+// token of the session, either in the CFG_CSRF_HEADER header or (for
+// WebSockets, which cannot set headers) in the csrf query parameter. Pages
+// are redirected to the login page if there is no session.
+// h  the handler to protect
+func requireSession(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isAPI := strings.HasPrefix(r.URL.Path, "/api/")
+		isWS := r.URL.Path == "/events"
+
+		if len(r.Header.Get("Authorization")) != 0 {
+			serveWithAPIToken(h, w, r)
+			return
+		}
+
+		session, err := sessions.get(r)
+		if err != nil {
+			if isAPI || isWS {
+				rejectWithStatusJSON(w, http.StatusUnauthorized, "unauthorized", "Please log in.")
+			} else {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			}
+			return
+		}
+
+		if isWS || (r.Method != "GET" && r.Method != "HEAD") {
+			token := r.Header.Get(CFG_CSRF_HEADER)
+			if isWS {
+				token = r.URL.Query().Get("csrf")
+			}
+
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				log.Println("[session] Invalid CSRF token for", r.Method, r.URL.Path)
+				rejectWithStatusJSON(w, http.StatusForbidden, "invalid_csrf_token", "The request could not be verified.")
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleLogin serves the login page and starts a new session if the correct
+// credentials are posted
+var handleLogin = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "POST" {
+		if _, err := sessions.get(r); err == nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(cfg.HTMLDir, "login.html"))
+		return
+	}
+
+	ok, blockedUntil := attemptLogin(r, r.PostFormValue("username"), r.PostFormValue("password"))
+	if !blockedUntil.IsZero() {
+		http.Redirect(w, r, "/login?blocked", http.StatusSeeOther)
+		return
+	} else if !ok {
+		http.Redirect(w, r, "/login?failed", http.StatusSeeOther)
+		return
+	}
+
+	if isTOTPEnabled() {
+		if err := beginPendingLogin(w, r.PostFormValue("username")); err != nil {
+			log.Println("[login] Starting the second login step failed:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login?totp", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := sessions.create(w); err != nil {
+		log.Println("[login] Creating the session failed:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[login] Login from", r.RemoteAddr)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+})
+
+// checkCredentials returns true if user and pass match the GUI credentials.
+// Password hashes using an outdated algorithm or cost are replaced.
+// user  the username
+// pass  the password
+func checkCredentials(user string, pass string) bool {
+	storedUser, err := storage.GetKeyValue("settings_auth_user")
+	if err != nil {
+		return false
+	}
+	storedPass, err := storage.GetKeyValue("settings_auth_pass")
+	if err != nil {
+		return false
+	}
+	salt, _ := storage.GetKeyValue("settings_auth_salt")
+
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(storedUser)) == 1
+	passOk, needsRehash := verifyPassword(pass, storedPass, salt, &cfg.PasswordHash)
+	if !userOk || !passOk {
+		return false
+	}
+
+	if needsRehash {
+		if err = storePassword(pass); err != nil {
+			log.Println("[login] Upgrading the password hash failed:", err)
+		} else {
+			log.Println("[login] Password hash upgraded to", cfg.PasswordHash.Algorithm)
+		}
+	}
+
+	return true
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64
+// n  the number of random bytes
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a session token
+// token  the session token
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"./persistence"
+	"github.com/codedust/go-tox"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Thumbnails of received and sent PNG, JPEG and GIF images are created when
+// the transfer is complete. They are stored as PNG files in the download
+// directory (like the files themselves under a random name) and shown in the
+// chat history.
+
+// createThumbnail creates the thumbnail of a transferred file in the
+// background and updates the clients if the file is an image
+// fileID  the id of the file
+func createThumbnail(fileID int64) {
+	go func() {
+		f, err := storage.GetFile(fileID)
+		if err != nil || len(f.StoredName) == 0 {
+			return
+		}
+
+		created, err := storeThumbnail(f)
+		if err != nil {
+			log.Println("[createThumbnail] Creating thumbnail of file", fileID, "failed:", err)
+			return
+		}
+		if created {
+			broadcastToClients(createSimpleJSONEvent("friendlist_update"))
+		}
+	}()
+}
+
+// storeThumbnail decodes a stored file and stores its thumbnail. Returns false
+// if the file is not an image (or too large to be decoded) or the thumbnail
+// does not fit into the download quota.
+// f  the file
+func storeThumbnail(f persistence.File) (bool, error) {
+	file, err := os.Open(filepath.Join(cfg.DownloadDir, filepath.Base(f.StoredName)))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > CFG_THUMBNAIL_MAX_PIXELS {
+		return false, nil
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return false, nil
+	}
+
+	thumbnail := scaleImage(img, CFG_THUMBNAIL_SIZE)
+
+	out, err := createStoredFile()
+	if err != nil {
+		return false, err
+	}
+	if err = png.Encode(out, thumbnail); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	info, statErr := os.Stat(out.Name())
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return false, err
+	}
+
+	// thumbnails count towards the download quota, which is checked in the
+	// main loop. The file may have been deleted while the thumbnail was
+	// created. The thumbnail is only stored if the file still exists, so it is
+	// either removed together with the file or here.
+	size := uint64(info.Size())
+	bounds := thumbnail.Bounds()
+	stored := false
+	err = toxDo(func(t *gotox.Tox) error {
+		if cfg.DownloadQuota != 0 && downloadUsage()+size > uint64(cfg.DownloadQuota) {
+			return nil
+		}
+
+		err := storage.StoreThumbnail(f.ID, filepath.Base(out.Name()), bounds.Dx(), bounds.Dy(), size)
+		if err == persistence.FileNotFound {
+			return nil
+		}
+		stored = err == nil
+		return err
+	})
+	if !stored {
+		os.Remove(out.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// scaleImage returns a copy of an image that fits into a square of the given
+// size. Each pixel is the average of the pixels it covers, smaller images are
+// not enlarged.
+// img   the image
+// size  the width and height of the square
+func scaleImage(img image.Image, size int) *image.NRGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size && w >= h {
+		h, w = h*size/w, size
+	} else if h > size {
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			thumbnail.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return thumbnail
+}
+
+// removeThumbnail deletes the thumbnail of a file
+// id  the id of the file
+func removeThumbnail(id int64) {
+	storedName, err := storage.DeleteThumbnail(id)
+	if err == nil && len(storedName) != 0 {
+		os.Remove(filepath.Join(cfg.DownloadDir, filepath.Base(storedName)))
+	}
+}
+
+// handleThumbnailDownload serves the thumbnail of a file
+// w   the response
+// r   the request
+// id  the id of the file (as in /api/files/{id}/thumbnail)
+func handleThumbnailDownload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rejectWithStatusJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "Thumbnails can only be downloaded with GET.")
+		return
+	}
+
+	fileID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		rejectWithStatusJSON(w, http.StatusNotFound, "thumbnail_not_found", "The thumbnail does not exist.")
+		return
+	}
+
+	f, err := storage.GetFile(fileID)
+	if err == persistence.FileNotFound || (err == nil && len(f.Thumbnail.StoredName) == 0) {
+		rejectWithStatusJSON(w, http.StatusNotFound, "thumbnail_not_found", "The thumbnail does not exist.")
+		return
+	} else if err != nil {
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(cfg.DownloadDir, filepath.Base(f.Thumbnail.StoredName)))
+	if err != nil {
+		log.Println("[handleThumbnailDownload] Opening thumbnail failed:", err)
+		rejectWithStatusJSON(w, http.StatusNotFound, "thumbnail_not_found", "The thumbnail does not exist.")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		rejectWithDefaultErrorJSON(w)
+		return
+	}
+
+	// thumbnails are created by us and always PNG images
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Two-factor authentication using time-based one-time passwords (RFC 6238)
+// with HMAC-SHA1, 6 digits and a period of 30 seconds, as supported by all
+// common authenticator apps. The following keys are used in keyValueStorage:
+//
+//	settings_totp_secret          the base32 encoded secret (2FA is enabled if set)
+//	settings_totp_pending_secret  the secret during enrollment
+//	settings_totp_last_counter    the time step of the last accepted code
+//	settings_totp_recovery_codes  a JSON list of SHA-256 hashes of unused recovery codes
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpModulus holds the powers of ten by the number of digits of a code
+// (RFC 4226 allows up to 9 digits for 31-bit values)
+var totpModulus = [...]uint32{1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000, 1000000000}
+
+// totpCode returns the code for the given time step
+// secret   the shared secret
+// counter  the time step
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation (RFC 4226, section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", CFG_TOTP_DIGITS, value%totpModulus[CFG_TOTP_DIGITS])
+}
+
+// verifyTOTP checks a code against the secret, allowing one time step of clock
+// drift in either direction. Returns the matching time step.
+// secret  the base32 encoded secret
+// code    the code entered by the user
+// now     the current time
+func verifyTOTP(secret string, code string, now time.Time) (bool, uint64) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != CFG_TOTP_DIGITS {
+		return false, 0
+	}
+
+	counter := uint64(now.Unix()) / uint64(CFG_TOTP_PERIOD.Seconds())
+	for _, c := range []uint64{counter, counter - 1, counter + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return true, c
+		}
+	}
+	return false, 0
+}
+
+// isTOTPEnabled returns true if two-factor authentication is enabled
+func isTOTPEnabled() bool {
+	secret, err := storage.GetKeyValue("settings_totp_secret")
+	return err == nil && len(secret) != 0
+}
+
+// beginTOTPEnrollment generates a new secret and returns it together with the
+// otpauth:// URI for authenticator apps. The secret is activated by
+// confirmTOTPEnrollment.
+func beginTOTPEnrollment() (string, string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+	if err := storage.StoreKeyValue("settings_totp_pending_secret", secret); err != nil {
+		return "", "", err
+	}
+
+	user, _ := storage.GetKeyValue("settings_auth_user")
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", CFG_TOTP_ISSUER)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(CFG_TOTP_DIGITS))
+	params.Set("period", strconv.Itoa(int(CFG_TOTP_PERIOD.Seconds())))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + CFG_TOTP_ISSUER + ":" + user,
+		RawQuery: params.Encode(),
+	}
+
+	return secret, uri.String(), nil
+}
+
+// confirmTOTPEnrollment enables two-factor authentication if code matches the
+// pending secret and returns new recovery codes
+// code  a code generated by the authenticator app
+func confirmTOTPEnrollment(code string) ([]string, bool) {
+	secret, err := storage.GetKeyValue("settings_totp_pending_secret")
+	if err != nil || len(secret) == 0 {
+		return nil, false
+	}
+
+	ok, counter := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, false
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("[totp] Generating recovery codes failed:", err)
+		return nil, false
+	}
+
+	storage.StoreKeyValue("settings_totp_secret", secret)
+	storage.StoreKeyValue("settings_totp_pending_secret", "")
+	storage.StoreKeyValue("settings_totp_last_counter", strconv.FormatUint(counter, 10))
+
+	log.Println("[totp] Two-factor authentication enabled")
+	return codes, true
+}
+
+// disableTOTP disables two-factor authentication
+func disableTOTP() {
+	storage.StoreKeyValue("settings_totp_secret", "")
+	storage.StoreKeyValue("settings_totp_pending_secret", "")
+	storage.StoreKeyValue("settings_totp_recovery_codes", "[]")
+	log.Println("[totp] Two-factor authentication disabled")
+}
+
+// checkSecondFactor checks a TOTP code or a recovery code. Each TOTP code and
+// each recovery code is only accepted once.
+// code  the code entered by the user
+func checkSecondFactor(code string) bool {
+	code = strings.TrimSpace(code)
+
+	secret, err := storage.GetKeyValue("settings_totp_secret")
+	if err != nil || len(secret) == 0 {
+		return false
+	}
+
+	if ok, counter := verifyTOTP(secret, code, time.Now()); ok {
+		last, _ := storage.GetKeyValue("settings_totp_last_counter")
+		if lastCounter, err := strconv.ParseUint(last, 10, 64); err == nil && counter <= lastCounter {
+			log.Println("[totp] Code has already been used")
+			return false
+		}
+		storage.StoreKeyValue("settings_totp_last_counter", strconv.FormatUint(counter, 10))
+		return true
+	}
+
+	return useRecoveryCode(code)
+}
+
+// generateRecoveryCodes replaces the recovery codes with new ones and returns
+// them. Only their hashes are stored.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, CFG_TOTP_RECOVERY_CODES)
+	hashes := make([]string, CFG_TOTP_RECOVERY_CODES)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(codes[i])
+	}
+
+	hashesJSON, _ := json.Marshal(hashes)
+	if err := storage.StoreKeyValue("settings_totp_recovery_codes", string(hashesJSON)); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// recoveryCodeHashes returns the hashes of the unused recovery codes
+func recoveryCodeHashes() []string {
+	var hashes []string
+	data, err := storage.GetKeyValue("settings_totp_recovery_codes")
+	if err == nil {
+		json.Unmarshal([]byte(data), &hashes)
+	}
+	return hashes
+}
+
+// useRecoveryCode returns true and invalidates the code if it is an unused
+// recovery code
+// code  the recovery code
+func useRecoveryCode(code string) bool {
+	hash := hashToken(strings.ToLower(code))
+	hashes := recoveryCodeHashes()
+
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			hashesJSON, _ := json.Marshal(hashes)
+			storage.StoreKeyValue("settings_totp_recovery_codes", string(hashesJSON))
+			log.Printf("[totp] Recovery code used, %d left\n", len(hashes))
+			return true
+		}
+	}
+	return false
+}
+
+// pendingLogin is a login that is waiting for the second factor
+type pendingLogin struct {
+	user     string
+	expires  time.Time
+	attempts int
+}
+
+// pendingLogins holds the logins waiting for the second factor by the hash of
+// the token in the CFG_PENDING_LOGIN_COOKIE cookie
+var pendingLogins = struct {
+	sync.Mutex
+	m map[string]*pendingLogin
+}{m: make(map[string]*pendingLogin)}
+
+// beginPendingLogin remembers a login with a correct password and sets the
+// cookie identifying it
+// w     the response the cookie is added to
+// user  the username
+func beginPendingLogin(w http.ResponseWriter, user string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	pendingLogins.Lock()
+	now := time.Now()
+	for id, p := range pendingLogins.m {
+		if now.After(p.expires) {
+			delete(pendingLogins.m, id)
+		}
+	}
+	pendingLogins.m[hashToken(token)] = &pendingLogin{user: user, expires: now.Add(CFG_PENDING_LOGIN_TIMEOUT)}
+	pendingLogins.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CFG_PENDING_LOGIN_COOKIE,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(CFG_PENDING_LOGIN_TIMEOUT.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// handleLoginTOTP completes a pending login if the correct second factor is
+// posted
+var handleLoginTOTP = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	cookie, err := r.Cookie(CFG_PENDING_LOGIN_COOKIE)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	id := hashToken(cookie.Value)
+
+	pendingLogins.Lock()
+	p := pendingLogins.m[id]
+	if p == nil || time.Now().After(p.expires) || p.attempts >= CFG_PENDING_LOGIN_ATTEMPTS {
+		delete(pendingLogins.m, id)
+		p = nil
+	} else {
+		p.attempts++
+	}
+	pendingLogins.Unlock()
+
+	if p == nil {
+		http.Redirect(w, r, "/login?expired", http.StatusSeeOther)
+		return
+	}
+
+	address := remoteIP(r)
+	if !logins.blocked(address, p.user).IsZero() {
+		http.Redirect(w, r, "/login?blocked", http.StatusSeeOther)
+		return
+	}
+
+	if !checkSecondFactor(r.PostFormValue("code")) {
+		log.Println("[login] Wrong second factor from", address)
+		logins.failure(address, p.user)
+		http.Redirect(w, r, "/login?totp&failed", http.StatusSeeOther)
+		return
+	}
+
+	pendingLogins.Lock()
+	delete(pendingLogins.m, id)
+	pendingLogins.Unlock()
+	logins.success(address, p.user)
+
+	http.SetCookie(w, &http.Cookie{Name: CFG_PENDING_LOGIN_COOKIE, Value: "", Path: "/login", MaxAge: -1, Secure: true})
+	if _, err := sessions.create(w); err != nil {
+		log.Println("[login] Creating the session failed:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("[login] Login from", address)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+})
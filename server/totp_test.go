@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors of RFC 6238 (appendix B), truncated to
+// CFG_TOTP_DIGITS digits
+var totpTestVectors = []struct {
+	time int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	for _, v := range totpTestVectors {
+		want := v.code[len(v.code)-CFG_TOTP_DIGITS:]
+		counter := uint64(v.time) / uint64(CFG_TOTP_PERIOD.Seconds())
+		if code := totpCode(secret, counter); code != want {
+			t.Errorf("code at %d is %s, want %s", v.time, code, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	for _, v := range totpTestVectors {
+		code := v.code[len(v.code)-CFG_TOTP_DIGITS:]
+		counter := uint64(v.time) / uint64(CFG_TOTP_PERIOD.Seconds())
+
+		// one time step of clock drift is allowed
+		for _, drift := range []time.Duration{0, -CFG_TOTP_PERIOD, CFG_TOTP_PERIOD} {
+			ok, c := verifyTOTP(secret, code, time.Unix(v.time, 0).Add(drift))
+			if !ok || c != counter {
+				t.Errorf("code %s at %d%+v: got %v, %d, want true, %d", code, v.time, drift, ok, c, counter)
+			}
+		}
+		if ok, _ := verifyTOTP(secret, code, time.Unix(v.time, 0).Add(2*CFG_TOTP_PERIOD)); ok {
+			t.Errorf("code %s accepted two time steps later", code)
+		}
+	}
+}
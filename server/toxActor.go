@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/codedust/go-tox"
+)
+
+// The global Tox instance is owned by the main loop. toxcore is not thread
+// safe, so any other goroutine (e.g. the HTTP and WebSocket handlers) must not
+// access the instance directly but send a toxCommand to the main loop using
+// toxDo. The Tox callbacks are called from within tox.Iterate() and may use
+// their Tox argument directly, but must never call toxDo themselves.
+
+// toxCommand is a function that is executed by the main loop together with
+// the channel its result is delivered to
+type toxCommand struct {
+	fn     func(t *gotox.Tox) error
+	result chan error
+}
+
+// toxCommands is used to send commands to the main loop
+var toxCommands = make(chan toxCommand)
+
+// toxDo executes fn in the main loop and waits for it to return. Results other
+// than the error have to be passed back using variables captured by fn.
+// fn  the function to execute with the Tox instance
+func toxDo(fn func(t *gotox.Tox) error) error {
+	cmd := toxCommand{fn: fn, result: make(chan error, 1)}
+	toxCommands <- cmd
+	return <-cmd.result
+}
+
+// run executes the command and delivers its result
+// t  the Tox instance
+func (cmd toxCommand) run(t *gotox.Tox) {
+	cmd.result <- cmd.fn(t)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codedust/go-tox"
+	"sync"
+	"testing"
+)
+
+// startTestLoop runs the commands sent with toxDo like the main loop does
+// until the returned function is called
+func startTestLoop() func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case cmd := <-toxCommands:
+				cmd.run(nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestToxDoConcurrent(t *testing.T) {
+	stop := startTestLoop()
+	defer stop()
+
+	const goroutines = 50
+	const calls = 100
+
+	// counter is not protected by a mutex, the race detector reports
+	// commands that are not serialized
+	counter := 0
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				want := fmt.Errorf("%d/%d", g, i)
+				err := toxDo(func(t *gotox.Tox) error {
+					counter++
+					return want
+				})
+				if err != want {
+					errs <- fmt.Errorf("call %d/%d got result %v", g, i, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if counter != goroutines*calls {
+		t.Errorf("%d commands executed, want %d", counter, goroutines*calls)
+	}
+}
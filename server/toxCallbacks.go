@@ -4,11 +4,54 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/codedust/go-tox"
+	"io"
 	"log"
-	"os"
+	"sync"
 	"time"
 )
 
+// selfConnection holds the current self connection status and the time of its
+// last change
+var selfConnection = struct {
+	sync.Mutex
+	status gotox.ToxConnection
+	since  time.Time
+}{status: gotox.TOX_CONNECTION_NONE, since: time.Now()}
+
+// getSelfConnectionStatus returns the current self connection status and the
+// time of its last change
+func getSelfConnectionStatus() (gotox.ToxConnection, time.Time) {
+	selfConnection.Lock()
+	defer selfConnection.Unlock()
+	return selfConnection.status, selfConnection.since
+}
+
+func onSelfConnectionStatusChanges(t *gotox.Tox, connectionStatus gotox.ToxConnection) {
+	type jsonEvent struct {
+		Type       string `json:"type"`
+		Connection string `json:"connection"`
+		Online     bool   `json:"online"`
+		Time       int64  `json:"time"`
+	}
+
+	now := time.Now()
+	selfConnection.Lock()
+	selfConnection.status = connectionStatus
+	selfConnection.since = now
+	selfConnection.Unlock()
+
+	log.Println("Self connection status changed:", getConnectionStatusAsString(connectionStatus))
+
+	e, _ := json.Marshal(jsonEvent{
+		Type:       "self_connection_status",
+		Connection: getConnectionStatusAsString(connectionStatus),
+		Online:     connectionStatus != gotox.TOX_CONNECTION_NONE,
+		Time:       now.Unix() * 1000,
+	})
+
+	broadcastToClients(string(e))
+}
+
 func onFriendRequest(t *gotox.Tox, publicKey []byte, message string) {
 	log.Printf("New friend request from %s\n", hex.EncodeToString(publicKey))
 
@@ -33,7 +76,7 @@ func onFriendMessage(t *gotox.Tox, friendnumber uint32, messagetype gotox.ToxMes
 		IsAction: messagetype == gotox.TOX_MESSAGE_TYPE_ACTION,
 	})
 
-	publicKey, _ := tox.FriendGetPublickey(friendnumber)
+	publicKey, _ := t.FriendGetPublickey(friendnumber)
 	storage.StoreMessage(hex.EncodeToString(publicKey), true, messagetype == gotox.TOX_MESSAGE_TYPE_ACTION, message)
 
 	broadcastToClients(string(e))
@@ -53,6 +96,16 @@ func onFriendConnectionStatusChanges(t *gotox.Tox, friendnumber uint32, connecti
 	})
 
 	broadcastToClients(string(e))
+
+	publicKey, _ := t.FriendGetPublickey(friendnumber)
+	if connectionStatus == gotox.TOX_CONNECTION_NONE {
+		dropFriendTransfers(publicKey, false)
+		delete(avatarSent, hex.EncodeToString(publicKey))
+	} else if !avatarSent[hex.EncodeToString(publicKey)] {
+		if err := sendAvatar(t, friendnumber); err != nil {
+			log.Println("[onFriendConnectionStatusChanges] Sending the avatar failed:", err)
+		}
+	}
 }
 
 func onFriendNameChanges(t *gotox.Tox, friendnumber uint32, newname string) {
@@ -104,34 +157,48 @@ func onFriendStatusChanges(t *gotox.Tox, friendnumber uint32, userstatus gotox.T
 }
 
 func onFileRecv(t *gotox.Tox, friendnumber uint32, filenumber uint32, kind gotox.ToxFileKind, filesize uint64, filename string) {
+	publicKey, err := t.FriendGetPublickey(friendnumber)
+	if err != nil {
+		t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		return
+	}
+	key := transferKey{publicKey: hex.EncodeToString(publicKey), fileNumber: filenumber}
+
 	if kind == gotox.TOX_FILE_KIND_AVATAR {
-		publicKey, _ := tox.FriendGetPublickey(friendnumber)
-		file, err := os.Create("../html/avatars/" + hex.EncodeToString(publicKey) + ".png")
-		if err != nil {
-			log.Println("[ERROR] Error creating file", "../html/avatars/"+hex.EncodeToString(publicKey)+".png")
-		}
+		receiveAvatar(t, key, friendnumber, filesize)
 
-		// only accept avatars with a file size <= CFG_MAX_AVATAR_SIZE
-		if filesize <= CFG_MAX_AVATAR_SIZE {
-			// append the file to the map of active file transfers
-			transfers[filenumber] = FileTransfer{fileHandle: file, fileSize: filesize, fileKind: kind}
+	} else if kind == gotox.TOX_FILE_KIND_DATA {
+		toxFileID, _ := t.FileGetFileId(friendnumber, filenumber)
+		if len(toxFileID) != 0 && resumeFile(t, key, friendnumber, hex.EncodeToString(toxFileID), filesize) {
+			broadcastToClients(createSimpleJSONEvent("transfers_update"))
+			return
+		}
 
-			t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_RESUME)
-		} else {
+		if err := checkDownloadQuota(filesize); err != nil {
+			log.Println("[onFileRecv] Rejecting file:", err)
 			t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_CANCEL)
+			onFileRejected(friendnumber, sanitizeFilename(filename), filesize, err)
+			return
 		}
 
-	} else if kind == gotox.TOX_FILE_KIND_DATA {
-		file, err := os.Create("../html/download/" + filename)
+		file, fileID, err := createDownloadFile(publicKey, filename, filesize)
 		if err != nil {
-			log.Println("[ERROR] Error creating file", "../html/download/"+filename)
+			log.Println("[ERROR] Error creating file:", err)
+			t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_CANCEL)
+			return
 		}
 
 		// append the file to the map of active file transfers
-		transfers[filenumber] = FileTransfer{fileHandle: file, fileSize: filesize, fileKind: kind}
+		transfer := FileTransfer{friendNumber: friendnumber, fileHandle: file, fileSize: filesize, fileKind: kind, fileID: fileID, fileName: sanitizeFilename(filename), toxFileID: hex.EncodeToString(toxFileID), state: TRANSFER_PENDING}
+		transfers.set(key, transfer)
 
-		// TODO do not accept any file send request without asking the user
-		t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_RESUME)
+		if shouldAutoAccept(publicKey, filesize) {
+			acceptTransfer(t, key, "")
+			broadcastToClients(createSimpleJSONEvent("transfers_update"))
+		} else {
+			onFileRequest(friendnumber, filenumber, transfer)
+		}
+		broadcastToClients(createSimpleJSONEvent("friendlist_update"))
 
 	} else {
 		log.Print("onFileRecv: unknown TOX_FILE_KIND: ", kind)
@@ -139,23 +206,45 @@ func onFileRecv(t *gotox.Tox, friendnumber uint32, filenumber uint32, kind gotox
 }
 
 func onFileRecvControl(t *gotox.Tox, friendnumber uint32, filenumber uint32, fileControl gotox.ToxFileControl) {
-	transfer, ok := transfers[filenumber]
+	key, err := friendTransferKey(t, friendnumber, filenumber)
+	if err != nil {
+		log.Println("Error: Friend does not exist")
+		return
+	}
+
+	transfer, ok := transfers.get(key)
 	if !ok {
 		log.Println("Error: File handle does not exist")
 		return
 	}
 
-	// TODO handle TOX_FILE_CONTROL_RESUME and TOX_FILE_CONTROL_PAUSE
-	if fileControl == gotox.TOX_FILE_CONTROL_CANCEL {
-		// delete file handle
-		transfer.fileHandle.Close()
-		delete(transfers, filenumber)
+	switch fileControl {
+	case gotox.TOX_FILE_CONTROL_RESUME:
+		// the friend accepted a file we offered or resumed a transfer
+		if transfer.state == TRANSFER_PENDING {
+			transfer.state = TRANSFER_RUNNING
+		}
+		transfer.pausedByFriend = false
+	case gotox.TOX_FILE_CONTROL_PAUSE:
+		transfer.pausedByFriend = true
+	case gotox.TOX_FILE_CONTROL_CANCEL:
+		// delete file handle and the incomplete file
+		finishTransfer(key, transfer, TRANSFER_FAILED)
+		return
 	}
+
+	transfers.set(key, notifyTransfer(key, updateTransferState(transfer), true))
 }
 
 func onFileRecvChunk(t *gotox.Tox, friendnumber uint32, filenumber uint32, position uint64, data []byte) {
-	transfer, ok := transfers[filenumber]
-	if !ok {
+	key, err := friendTransferKey(t, friendnumber, filenumber)
+	if err != nil {
+		log.Println("Error: Friend does not exist")
+		return
+	}
+
+	transfer, ok := transfers.get(key)
+	if !ok || transfer.outgoing {
 		if len(data) == 0 {
 			// ignore the zero-length chunk that indicates that the transfer is
 			// complete (see below)
@@ -167,26 +256,170 @@ func onFileRecvChunk(t *gotox.Tox, friendnumber uint32, filenumber uint32, posit
 	}
 
 	// write data to the file handle
-	transfer.fileHandle.WriteAt(data, (int64)(position))
+	if _, err := transfer.fileHandle.WriteAt(data, (int64)(position)); err != nil {
+		log.Println("Error: Writing chunk failed:", err)
+		t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		finishTransfer(key, transfer, TRANSFER_FAILED)
+		return
+	}
+	transfer.position = position + uint64(len(data))
 
 	// file transfer completed
-	if position+uint64(len(data)) >= transfer.fileSize {
+	if transfer.position >= transfer.fileSize {
 		// Some clients will send us another zero-length chunk without data (only
 		// required for stream, not necessary for files with a known size) and some
 		// will not.
 		// We will delete the file handle now (we aleady reveived the whole file)
 		// and ignore the file handle error when the empty chunk arrives.
 
-		fileKind := transfer.fileKind
-
-		transfer.fileHandle.Sync()
-		transfer.fileHandle.Close()
-		delete(transfers, filenumber)
+		if transfer.fileKind == gotox.TOX_FILE_KIND_DATA {
+			storage.SetFileComplete(transfer.fileID)
+			createThumbnail(transfer.fileID)
+		}
+		finishTransfer(key, transfer, TRANSFER_DONE)
 		log.Println("File transfer completed (receiving)", filenumber)
 
-		if fileKind == gotox.TOX_FILE_KIND_AVATAR {
-			// update friendlist
-			broadcastToClients(createSimpleJSONEvent("avatar_update"))
+		if transfer.fileKind == gotox.TOX_FILE_KIND_AVATAR {
+			storeFriendAvatar(key, transfer)
+		} else {
+			onFileReceived(friendnumber, transfer.fileID)
+		}
+		return
+	}
+
+	transfers.set(key, saveTransferPosition(notifyTransfer(key, transfer, false), false))
+}
+
+func onFileChunkRequest(t *gotox.Tox, friendnumber uint32, filenumber uint32, position uint64, length uint64) {
+	key, err := friendTransferKey(t, friendnumber, filenumber)
+	if err != nil {
+		log.Println("Error: Friend does not exist")
+		return
+	}
+
+	transfer, ok := transfers.get(key)
+	if !ok || !transfer.outgoing {
+		log.Println("Error: File handle does not exist")
+		return
+	}
+
+	// file transfer completed
+	if length == 0 {
+		finishTransfer(key, transfer, TRANSFER_DONE)
+		log.Println("File transfer completed (sending)", filenumber)
+
+		if transfer.fileKind == gotox.TOX_FILE_KIND_DATA {
+			storage.SetFileComplete(transfer.fileID)
+			createThumbnail(transfer.fileID)
+			onFileSent(friendnumber, transfer.fileID)
 		}
+		return
 	}
+
+	data := make([]byte, length)
+	n, err := transfer.fileHandle.ReadAt(data, int64(position))
+	if err != nil && err != io.EOF {
+		log.Println("Error: Reading file failed:", err)
+		t.FileControl(friendnumber, filenumber, gotox.TOX_FILE_CONTROL_CANCEL)
+		finishTransfer(key, transfer, TRANSFER_FAILED)
+		return
+	}
+
+	if err = t.FileSendChunk(friendnumber, filenumber, position, data[:n]); err != nil {
+		log.Println("Error: Sending chunk failed:", err)
+		return
+	}
+
+	transfer.position = position + uint64(n)
+	transfers.set(key, notifyTransfer(key, transfer, false))
+}
+
+// onFileRequest asks the clients to accept or reject an incoming file
+func onFileRequest(friendnumber uint32, filenumber uint32, transfer FileTransfer) {
+	type jsonEvent struct {
+		Type   string `json:"type"`
+		Friend uint32 `json:"friend"`
+		File   uint32 `json:"file"`
+		ID     int64  `json:"id"`
+		Name   string `json:"name"`
+		Size   uint64 `json:"size"`
+	}
+
+	e, _ := json.Marshal(jsonEvent{
+		Type:   "file_request",
+		Friend: friendnumber,
+		File:   filenumber,
+		ID:     transfer.fileID,
+		Name:   transfer.fileName,
+		Size:   transfer.fileSize,
+	})
+
+	broadcastToClients(string(e))
+}
+
+// onFileRejected notifies the clients about a file that has been rejected
+// because of the download quota
+func onFileRejected(friendnumber uint32, name string, size uint64, reason error) {
+	type jsonEvent struct {
+		Type   string `json:"type"`
+		Friend uint32 `json:"friend"`
+		Name   string `json:"name"`
+		Size   uint64 `json:"size"`
+		Reason string `json:"reason"`
+	}
+
+	e, _ := json.Marshal(jsonEvent{
+		Type:   "file_rejected",
+		Friend: friendnumber,
+		Name:   name,
+		Size:   size,
+		Reason: reason.Error(),
+	})
+
+	broadcastToClients(string(e))
+}
+
+// onFileReceived notifies the clients about a completely received file
+func onFileReceived(friendnumber uint32, fileID int64) {
+	type jsonEvent struct {
+		Type   string `json:"type"`
+		Friend uint32 `json:"friend"`
+		ID     int64  `json:"id"`
+		Name   string `json:"name"`
+		Size   uint64 `json:"size"`
+		Time   int64  `json:"time"`
+	}
+
+	f, err := storage.GetFile(fileID)
+	if err != nil {
+		return
+	}
+
+	e, _ := json.Marshal(jsonEvent{
+		Type:   "file_received",
+		Friend: friendnumber,
+		ID:     f.ID,
+		Name:   f.FileName,
+		Size:   f.Size,
+		Time:   f.Time,
+	})
+
+	broadcastToClients(string(e))
+}
+
+// onFileSent notifies the clients about a completely sent file
+func onFileSent(friendnumber uint32, fileID int64) {
+	type jsonEvent struct {
+		Type   string `json:"type"`
+		Friend uint32 `json:"friend"`
+		ID     int64  `json:"id"`
+	}
+
+	e, _ := json.Marshal(jsonEvent{
+		Type:   "file_sent",
+		Friend: friendnumber,
+		ID:     fileID,
+	})
+
+	broadcastToClients(string(e))
 }
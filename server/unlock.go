@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codedust/go-httpserve"
+	"golang.org/x/crypto/ssh/terminal"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// unlockSavedata decrypts encrypted savedata. If passphrase is empty, the
+// passphrase is read from the terminal or, if WebTox does not run in a
+// terminal, requested using the unlock page.
+// data        the encrypted savedata
+// passphrase  the passphrase given by flag or environment (may be empty)
+func unlockSavedata(data []byte, passphrase string) ([]byte, *passKey, error) {
+	if len(passphrase) != 0 {
+		return decryptData(passphrase, data)
+	}
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return unlockSavedataFromTerminal(data)
+	}
+
+	return unlockSavedataFromWeb(data)
+}
+
+// unlockSavedataFromTerminal asks for the passphrase on the terminal (up to
+// three times)
+// data  the encrypted savedata
+func unlockSavedataFromTerminal(data []byte) ([]byte, *passKey, error) {
+	err := ErrWrongPassphrase
+	for i := 0; i < 3; i++ {
+		fmt.Print("Passphrase for the Tox profile: ")
+		passphrase, readErr := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+
+		var plain []byte
+		var pk *passKey
+		if plain, pk, err = decryptData(string(passphrase), data); err == nil {
+			return plain, pk, nil
+		}
+		fmt.Println(err)
+	}
+
+	return nil, nil, err
+}
+
+// unlockSavedataFromWeb serves the unlock page until the correct passphrase
+// has been entered. The page requires a session, so the user has to log in
+// (including the second step if TOTP is enabled) before unlocking. The session
+// stays valid after WebTox has started.
+// data  the encrypted savedata
+func unlockSavedataFromWeb(data []byte) ([]byte, *passKey, error) {
+	type result struct {
+		plain []byte
+		pk    *passKey
+	}
+	unlocked := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.Handle("/unlock", requireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		plain, pk, err := decryptData(r.PostFormValue("passphrase"), data)
+		if err != nil {
+			log.Println("[unlock] Unlocking the Tox profile failed:", err)
+			rejectWithErrorJSON(w, "wrong_passphrase", "Wrong passphrase.")
+			return
+		}
+
+		select {
+		case unlocked <- result{plain, pk}:
+		default:
+		}
+
+		fmt.Fprint(w, "{}")
+	})))
+	mux.Handle("/", requireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filepath.Join(cfg.HTMLDir, "unlock.html"))
+	})))
+	mux.Handle("/login", handleLogin)
+	mux.Handle("/login/totp", handleLoginTOTP)
+	mux.Handle("/bootstrap/", http.FileServer(http.Dir(cfg.HTMLDir)))
+	mux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(filepath.Join(cfg.HTMLDir, "img")))))
+
+	httpserve.CreateCertificateIfNotExist(cfg.CertFile, cfg.KeyFile, "localhost", 3072)
+
+	gui, err := startGUIServer(restrictAddresses(mux))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("[unlock] The Tox profile is encrypted. Visit https://" + cfg.ListenAddresses[0] + "/ to unlock it.")
+
+	select {
+	case res := <-unlocked:
+		// wait for the response to be delivered before shutting down
+		gui.shutdown(5 * time.Second)
+		return res.plain, res.pk, nil
+	case err := <-gui.errors:
+		return nil, nil, err
+	}
+}